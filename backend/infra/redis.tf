@@ -0,0 +1,31 @@
+# Every task shares the rooms, messages, tickets, rate limits and chat events
+# through this node, the service runs with BROKER=redis and MESSAGE_STORE=redis
+resource "aws_elasticache_subnet_group" "redis" {
+  name       = "${local.service_name}-redis"
+  subnet_ids = local.private_subnet_ids
+}
+
+resource "aws_security_group" "redis_sg" {
+  vpc_id = local.vpc_id
+  ingress {
+    security_groups = [aws_security_group.service_sg.id]
+    protocol        = "tcp"
+    from_port       = local.redis_port
+    to_port         = local.redis_port
+  }
+}
+
+resource "aws_elasticache_cluster" "redis" {
+  cluster_id           = local.service_name
+  engine               = "redis"
+  engine_version       = "7.1"
+  node_type            = "cache.t4g.micro"
+  num_cache_nodes      = 1
+  parameter_group_name = "default.redis7"
+  port                 = local.redis_port
+  subnet_group_name    = aws_elasticache_subnet_group.redis.name
+  security_group_ids   = [aws_security_group.redis_sg.id]
+  tags = {
+    Service = local.service_name
+  }
+}
@@ -7,6 +7,7 @@ locals {
   health_path         = "/health"
   api_path_prefix     = "/api"
   ws_path_prefix      = "/ws"
+  redis_port          = 6379
 }
 
 resource "aws_lb_target_group" "group" {
@@ -58,6 +59,12 @@ resource "aws_security_group" "service_sg" {
     from_port   = 443
     to_port     = 443
   }
+  egress {
+    cidr_blocks = [local.vpc_cidr]
+    protocol    = "tcp"
+    from_port   = local.redis_port
+    to_port     = local.redis_port
+  }
 }
 
 module "service" {
@@ -94,11 +101,14 @@ module "service" {
       WS_PATH_PREFIX  = local.ws_path_prefix
       # noinspection HILUnresolvedReference
       OPENID_CONFIGURATION_URL = local.discovery_endpoints.openid_configuration
-      # noinspection HILUnresolvedReference
-      JWKS_URL            = local.discovery_endpoints.jwks
-      USER_POOL_ID        = local.user_pool_id
-      AVATARS_BUCKET_NAME = module.bucket.name
-      REGION              = var.region
+      CLIENT_IDS               = local.frontend_client_id
+      USER_POOL_ID             = local.user_pool_id
+      AVATARS_BUCKET_NAME      = module.bucket.name
+      REGION                   = var.region
+      BROKER                   = "redis"
+      MESSAGE_STORE            = "redis"
+      RATE_LIMITER             = "redis"
+      REDIS_URL                = "redis://${aws_elasticache_cluster.redis.cache_nodes[0].address}:${local.redis_port}"
     }
   }]
   target_groups = [{
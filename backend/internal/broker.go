@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	BrokerMemory = "memory"
+	BrokerRedis  = "redis"
+)
+
+const (
+	// EnvelopeRoom goes to the connections that joined the room
+	EnvelopeRoom = "room"
+	// EnvelopeUsers goes to every connection of the users of the tenant
+	EnvelopeUsers = "users"
+	// EnvelopeEvict detaches the connections of the users of the tenant from the room
+	EnvelopeEvict = "evict"
+	// EnvelopePresence reports the presence of a user on the publishing instance
+	EnvelopePresence = "presence"
+	// EnvelopeStream carries a frame posted for an SSE stream to the instance holding it
+	EnvelopeStream = "stream"
+)
+
+// Envelope is the unit of fan-out between hub instances
+type Envelope struct {
+	Kind     string    `json:"kind"`
+	Instance string    `json:"instance"`
+	Room     string    `json:"room,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Users    []string  `json:"users,omitempty"`
+	Except   string    `json:"except,omitempty"`
+	Frame    *Frame    `json:"frame,omitempty"`
+	Presence *Presence `json:"presence,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	User     string    `json:"user,omitempty"`
+}
+
+// Broker fans envelopes out to every instance of the service,
+// the publishing one included, in the order they were published
+type Broker interface {
+	Publish(ctx context.Context, envelope *Envelope) error
+	// Subscribe passes every envelope published after it returns to fn
+	Subscribe(ctx context.Context, fn func(envelope *Envelope)) error
+	Close() error
+}
+
+func NewBroker(ctx context.Context, config *Config, logger *zap.Logger) (Broker, error) {
+	switch config.Broker {
+	case BrokerRedis:
+		return NewRedisBroker(ctx, config.RedisUrl, config.RedisChannel, logger)
+	default:
+		return NewMemoryBroker(), nil
+	}
+}
+
+// MemoryBroker serves a single instance, envelopes are handed to the
+// subscribers synchronously
+type MemoryBroker struct {
+	mutex       sync.RWMutex
+	subscribers []func(envelope *Envelope)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(_ context.Context, envelope *Envelope) error {
+	b.mutex.RLock()
+	subscribers := b.subscribers
+	b.mutex.RUnlock()
+	for _, fn := range subscribers {
+		fn(envelope)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(_ context.Context, fn func(envelope *Envelope)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+	return nil
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+// RedisBroker publishes envelopes as JSON on a Redis pub/sub channel.
+// Pub/sub is fire and forget, envelopes published while an instance
+// is reconnecting are lost for that instance.
+type RedisBroker struct {
+	logger  *zap.Logger
+	client  *redis.Client
+	channel string
+	mutex   sync.Mutex
+	pubsubs []*redis.PubSub
+}
+
+func NewRedisBroker(ctx context.Context, url, channel string, logger *zap.Logger) (*RedisBroker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(ctx).Err(); err != nil {
+		ignore(client.Close)
+		return nil, err
+	}
+	return &RedisBroker{
+		logger:  logger,
+		client:  client,
+		channel: channel,
+	}, nil
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, envelope *Envelope) error {
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, fn func(envelope *Envelope)) error {
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	// Wait for the confirmation so nothing published afterwards is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		ignore(pubsub.Close)
+		return err
+	}
+	b.mutex.Lock()
+	b.pubsubs = append(b.pubsubs, pubsub)
+	b.mutex.Unlock()
+	go func() {
+		for message := range pubsub.Channel() {
+			var envelope Envelope
+			if err := json.Unmarshal([]byte(message.Payload), &envelope); err != nil {
+				b.logger.Warn("dropping malformed envelope", zap.Error(err))
+				continue
+			}
+			fn(&envelope)
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, pubsub := range b.pubsubs {
+		ignore(pubsub.Close)
+	}
+	b.pubsubs = nil
+	return b.client.Close()
+}
@@ -1,32 +1,178 @@
 package internal
 
 import (
+	"errors"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
+const (
+	BearerSubprotocolPrefix = "bearer."
+	TicketQueryParam        = "ticket"
+)
+
 type ChatRouter struct {
-	logger *zap.Logger
-	router *mux.Router
+	logger    *zap.Logger
+	router    *mux.Router
+	apiRouter *mux.Router
+	hub       *Hub
+	validator *TokenValidator
+	tickets   TicketStore
+	upgrader  websocket.Upgrader
 }
 
-func NewChatRouter(logger *zap.Logger,
-	rootRouter *mux.Router,
-	validator *TokenValidator) *ChatRouter {
-	router := rootRouter.PathPrefix("/chat").Subrouter()
-	router.Use(validator.ValidatingMiddleware)
+func NewChatRouter(config *Config,
+	logger *zap.Logger,
+	wsRouter *mux.Router,
+	apiRouter *mux.Router,
+	validator *TokenValidator,
+	tickets TicketStore,
+	hub *Hub) *ChatRouter {
+	router := wsRouter.PathPrefix("/chat").Subrouter()
+	chatApiRouter := apiRouter.PathPrefix("/chat").Subrouter()
+	chatApiRouter.Use(validator.ValidatingMiddleware)
 	chatRouter := &ChatRouter{logger: logger,
-		router: router}
+		router:    router,
+		apiRouter: chatApiRouter,
+		hub:       hub,
+		validator: validator,
+		tickets:   tickets,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Subprotocols:    ChatSubprotocols,
+			// gorilla/websocket only negotiates permessage-deflate without context
+			// takeover, each message is compressed on its own and repeated keys are
+			// not shared across frames. Frames below WsCompressionThreshold are sent as is.
+			EnableCompression: config.WsCompression,
+			// Authentication does not rely on cookies, so cross-origin
+			// handshakes can not ride on the user's ambient credentials.
+			CheckOrigin: func(*http.Request) bool { return true },
+		}}
+	router.Use(chatRouter.authenticatingMiddleware)
 	chatRouter.registerRoutes()
 	return chatRouter
 }
 
 func (r *ChatRouter) registerRoutes() {
 	r.router.HandleFunc("/", r.Chat)
+	r.apiRouter.HandleFunc("/tickets", r.IssueTicket).Methods("POST")
+	r.apiRouter.HandleFunc("/stream", r.Stream).Methods("GET")
+	r.apiRouter.HandleFunc("/messages", r.PostFrame).Methods("POST")
+}
+
+// authenticatingMiddleware accepts, in order, a ticket issued by IssueTicket,
+// a token passed as a "bearer.<token>" WebSocket subprotocol
+// and finally a regular Authorization header.
+func (r *ChatRouter) authenticatingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ticketId := req.URL.Query().Get(TicketQueryParam); ticketId != "" {
+			ticket, err := r.tickets.Redeem(req.Context(), ticketId)
+			if errors.Is(err, ErrTicketNotFound) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				r.logger.Error("unable to redeem ticket", zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, req.WithContext(WithParsedToken(req.Context(), ticket.Token, ticket.Tenant)))
+			return
+		}
+		if tokenStr, ok := subprotocolToken(req); ok {
+			r.validator.serveWithToken(w, req, tokenStr, next)
+			return
+		}
+		r.validator.ValidatingMiddleware(next).ServeHTTP(w, req)
+	})
+}
+
+func subprotocolToken(r *http.Request) (string, bool) {
+	protocol, ok := bearerSubprotocol(r)
+	return strings.TrimPrefix(protocol, BearerSubprotocolPrefix), ok
+}
+
+func bearerSubprotocol(r *http.Request) (string, bool) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, BearerSubprotocolPrefix) {
+			return protocol, true
+		}
+	}
+	return "", false
+}
+
+// upgraderFor echoes the bearer subprotocol when it is the only one offered,
+// browsers fail the handshake when none of their subprotocols is selected
+func (r *ChatRouter) upgraderFor(req *http.Request) *websocket.Upgrader {
+	offered := websocket.Subprotocols(req)
+	bearer, ok := bearerSubprotocol(req)
+	if !ok || slices.ContainsFunc(offered, func(protocol string) bool {
+		return slices.Contains(ChatSubprotocols, protocol)
+	}) {
+		return &r.upgrader
+	}
+	upgrader := r.upgrader
+	upgrader.Subprotocols = []string{bearer}
+	return &upgrader
+}
+
+type TicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (r *ChatRouter) IssueTicket(w http.ResponseWriter, req *http.Request) {
+	id, ticket, err := r.tickets.Issue(req.Context(), GetParsedToken(req), GetTenant(req))
+	if err != nil {
+		r.logger.Error("unable to issue ticket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, &TicketResponse{
+		Ticket:    id,
+		ExpiresAt: ticket.ExpiresAt,
+	}, http.StatusOK)
+}
+
+// connectingUser returns the user opening a chat connection and when their token
+// expires, replying with an error when the connection can not be opened
+func (r *ChatRouter) connectingUser(w http.ResponseWriter, req *http.Request) (string, time.Time, bool) {
+	token := GetParsedToken(req)
+	username, err := GetTokenUsername(token)
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", time.Time{}, false
+	}
+	expiresAt, err := token.Claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", time.Time{}, false
+	}
+	if r.hub.Draining() {
+		WriteString(w, "server going away", http.StatusServiceUnavailable)
+		return "", time.Time{}, false
+	}
+	return username, expiresAt.Time, true
 }
 
-func (r *ChatRouter) Chat(w http.ResponseWriter, _ *http.Request) {
-	WriteString(w, "Hello", http.StatusOK)
+func (r *ChatRouter) Chat(w http.ResponseWriter, req *http.Request) {
+	username, expiresAt, ok := r.connectingUser(w, req)
+	if !ok {
+		return
+	}
+	conn, err := r.upgraderFor(req).Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error
+		r.logger.Warn("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	NewClient(r.hub, conn, username, GetTenant(req), expiresAt, r.validator, r.logger).Run()
 }
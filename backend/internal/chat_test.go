@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestChatHandshakeSubprotocol(t *testing.T) {
+	router := &ChatRouter{upgrader: websocket.Upgrader{Subprotocols: ChatSubprotocols}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := router.upgraderFor(req).Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		ignore(conn.Close)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	tests := []struct {
+		name    string
+		offered []string
+		want    string
+	}{
+		{name: "CBOR", offered: []string{SubprotocolV1Json, SubprotocolV1Cbor}, want: SubprotocolV1Cbor},
+		{name: "JSON with a token", offered: []string{"bearer.token", SubprotocolV1Json}, want: SubprotocolV1Json},
+		// Browsers fail the handshake when none of their subprotocols is selected
+		{name: "token alone", offered: []string{"bearer.token"}, want: "bearer.token"},
+		{name: "unknown", offered: []string{"raccoon"}, want: ""},
+		{name: "none", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: test.offered}
+			conn, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ignore(conn.Close)
+			if conn.Subprotocol() != test.want {
+				t.Errorf("selected %q, want %q", conn.Subprotocol(), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const maxMessageSize = 64 * 1024
+
+const (
+	CloseTokenExpired = 4001
+	// CloseSlowConsumer is sent to a client that does not keep up with its queue
+	CloseSlowConsumer = 4002
+	// CloseIdle is sent to a client that has not sent a frame for WsIdleTimeout
+	CloseIdle = 4003
+)
+
+const goingAwayReason = "server going away, reconnect"
+
+type Client struct {
+	hub         *Hub
+	conn        *websocket.Conn
+	codec       Codec
+	logger      *zap.Logger
+	validator   *TokenValidator
+	username    string
+	tenant      string
+	send        chan *Frame
+	mutex       sync.Mutex
+	closed      bool
+	closeCode   int
+	closeReason string
+	authTimer   *time.Timer
+	// idleTimer is nil when idle connections are kept open
+	idleTimer *time.Timer
+	// held buffers live frames per room while a resume replays the missed messages
+	held map[string][]*Frame
+	// rooms is guarded by the hub mutex
+	rooms map[string]struct{}
+}
+
+func NewClient(hub *Hub,
+	conn *websocket.Conn,
+	username string,
+	tenant string,
+	expiresAt time.Time,
+	validator *TokenValidator,
+	logger *zap.Logger) *Client {
+	client := &Client{
+		hub:       hub,
+		conn:      conn,
+		codec:     jsonCodec{},
+		logger:    logger.With(zap.String("username", username), zap.String("tenant", tenant)),
+		validator: validator,
+		username:  username,
+		tenant:    tenant,
+		send:      make(chan *Frame, hub.config.WsSendQueueSize),
+		held:      make(map[string][]*Frame),
+		rooms:     make(map[string]struct{}),
+	}
+	if conn != nil {
+		client.codec = CodecFor(conn.Subprotocol())
+		// Validated with the config, only fails outside of the flate levels
+		_ = conn.SetCompressionLevel(hub.config.WsCompressionLevel)
+	}
+	client.authTimer = time.AfterFunc(time.Until(expiresAt), client.expire)
+	if hub.config.WsIdleTimeout > 0 {
+		client.idleTimer = time.AfterFunc(hub.config.WsIdleTimeout, client.idle)
+	}
+	return client
+}
+
+func (c *Client) userKey() string {
+	return UserKey(c.tenant, c.username)
+}
+
+// touch postpones the idle timeout
+func (c *Client) touch() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.hub.config.WsIdleTimeout)
+	}
+}
+
+func (c *Client) idle() {
+	c.logger.Info("closing idle chat connection")
+	c.Shutdown(CloseIdle, "idle timeout")
+}
+
+// expire closes the connection once the token it was opened with
+// (or the last one sent in an auth frame) is no longer valid.
+func (c *Client) expire() {
+	c.logger.Info("chat token expired, closing connection")
+	if c.conn == nil {
+		c.Shutdown(CloseTokenExpired, "token expired")
+		return
+	}
+	message := websocket.FormatCloseMessage(CloseTokenExpired, "token expired")
+	_ = c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(c.hub.config.WsWriteTimeout))
+	ignore(c.conn.Close)
+}
+
+func (c *Client) reauthenticate(frame *Frame) {
+	valid, token, err := c.validator.ValidateToken(context.Background(), frame.Body)
+	if err != nil || !valid {
+		c.logger.Info("chat re-authentication failed", zap.Error(err))
+		message := "invalid token"
+		var tokenErr *TokenError
+		if errors.As(err, &tokenErr) {
+			message = tokenErr.Description
+		}
+		c.Enqueue(NewErrorFrame("", ErrorInvalidToken, message))
+		return
+	}
+	username, err := GetTokenUsername(token)
+	if err != nil || username != c.username || c.validator.Tenant(token) != c.tenant {
+		c.Enqueue(NewErrorFrame("", ErrorInvalidToken, "token belongs to a different user"))
+		return
+	}
+	expiresAt, err := token.Claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		c.Enqueue(NewErrorFrame("", ErrorInvalidToken, "token has no expiration time"))
+		return
+	}
+	c.authTimer.Reset(time.Until(expiresAt.Time))
+	c.Enqueue(&Frame{Type: FrameAuth, Timestamp: time.Now().UTC()})
+}
+
+// Enqueue never blocks. A client whose queue is full gets closed
+// so a single slow connection can not stall the broadcast.
+func (c *Client) Enqueue(frame *Frame) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		metricFramesDropped.Add(1)
+		return false
+	}
+	if held, ok := c.held[frame.Room]; ok {
+		if len(held) < cap(c.send) {
+			c.held[frame.Room] = append(held, frame)
+			return true
+		}
+		c.overflow()
+		return false
+	}
+	return c.push(frame)
+}
+
+// push must be called with the mutex held
+func (c *Client) push(frame *Frame) bool {
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		c.overflow()
+		return false
+	}
+}
+
+// overflow must be called with the mutex held. The queued frames are dropped
+// so the close frame is written next instead of after the whole backlog.
+func (c *Client) overflow() {
+	c.logger.Warn("closing slow chat client")
+	metricSlowConsumers.Add(1)
+	metricFramesDropped.Add(1)
+	for dropped := true; dropped; {
+		select {
+		case <-c.send:
+			metricFramesDropped.Add(1)
+		default:
+			dropped = false
+		}
+	}
+	c.shutdown(CloseSlowConsumer, "slow consumer")
+}
+
+// Shutdown closes the connection with the code once the frames
+// already queued are written
+func (c *Client) Shutdown(code int, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shutdown(code, reason)
+}
+
+// shutdown must be called with the mutex held
+func (c *Client) shutdown(code int, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// Hold starts buffering the live frames of the room
+func (c *Client) Hold(room string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.held[room] = nil
+}
+
+// Release queues the replayed frames followed by the live frames held in the
+// meantime, leaving out the messages the replay already covered. A replay that
+// does not fit into the free space of the queue is cut short and ends with a
+// resume.gap instead, the client fetches the rest of the messages itself.
+func (c *Client) Release(room string, replay []*Frame, replayed uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	held := c.held[room]
+	delete(c.held, room)
+	if c.closed {
+		return false
+	}
+	if free := cap(c.send) - len(c.send) - len(held); len(replay) > free {
+		kept := max(free-1, 0)
+		gap := &Frame{Type: FrameResumeGap, Room: room, Seq: replayed, Timestamp: time.Now().UTC()}
+		replay = append(replay[:kept:kept], gap)
+		metricResumesCut.Add(1)
+	}
+	for _, frame := range replay {
+		if !c.push(frame) {
+			return false
+		}
+	}
+	for _, frame := range held {
+		if frame.Type == FrameMessage && frame.Seq <= replayed {
+			continue
+		}
+		if !c.push(frame) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.shutdown(0, "")
+}
+
+func (c *Client) Run() {
+	metricConnections.Add(1)
+	c.hub.Register(c)
+	go c.writePump()
+	go c.readPump()
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.authTimer.Stop()
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.hub.Unregister(c)
+		ignore(c.conn.Close)
+		metricConnections.Add(-1)
+		metricConnectionsClosed.Add(1)
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	pongTimeout := c.hub.config.WsPongTimeout
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err,
+				websocket.CloseGoingAway,
+				websocket.CloseNormalClosure) {
+				c.logger.Warn("chat connection closed unexpectedly", zap.Error(err))
+			}
+			return
+		}
+		// Pongs keep the connection alive but only frames count as activity
+		c.touch()
+		var frame Frame
+		if err = c.codec.Decode(data, &frame); err != nil {
+			c.Enqueue(NewErrorFrame("", ErrorMalformedFrame, "malformed frame"))
+			continue
+		}
+		if frame.Type == FrameAuth {
+			c.reauthenticate(&frame)
+			continue
+		}
+		if ok, wait := c.hub.Throttle(c.tenant, c.username, &frame); !ok {
+			c.Enqueue(NewRateLimitedFrame(frame.Room, wait))
+			continue
+		}
+		c.hub.HandleFrame(c, &frame)
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.config.WsPingInterval)
+	defer func() {
+		ticker.Stop()
+		ignore(c.conn.Close)
+	}()
+	writeTimeout := c.hub.config.WsWriteTimeout
+	compressionThreshold := c.hub.config.WsCompressionThreshold
+	for {
+		select {
+		case frame, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				c.writeClose()
+				return
+			}
+			data, err := c.codec.Encode(frame)
+			if err != nil {
+				c.logger.Error("failed to encode chat frame", zap.Error(err))
+				continue
+			}
+			// Has no effect unless the client negotiated compression
+			c.conn.EnableWriteCompression(len(data) >= compressionThreshold)
+			if err = c.conn.WriteMessage(c.codec.MessageType(), data); err != nil {
+				c.writeFailed(err)
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.writeFailed(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writeClose() {
+	c.mutex.Lock()
+	code, reason := c.closeCode, c.closeReason
+	c.mutex.Unlock()
+	message := []byte{}
+	if code != 0 {
+		message = websocket.FormatCloseMessage(code, reason)
+	}
+	_ = c.conn.WriteMessage(websocket.CloseMessage, message)
+}
+
+func (c *Client) writeFailed(err error) {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.logger.Warn("chat write timed out")
+		metricWriteTimeouts.Add(1)
+	case !errors.Is(err, websocket.ErrCloseSent):
+		c.logger.Debug("failed to write chat frame", zap.Error(err))
+	}
+}
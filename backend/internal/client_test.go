@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestClientShutdown(t *testing.T) {
+	config := &Config{}
+	config.SetDefaults()
+	config.WsSendQueueSize = 2
+	hub := newConfiguredHub(t, config, NewMemoryBroker())
+	newClient := func() *Client {
+		return NewClient(hub.Hub, nil, "alice", DefaultTenant, time.Now().Add(time.Hour), nil, zap.NewNop())
+	}
+
+	t.Run("slow consumer", func(t *testing.T) {
+		client := newClient()
+		for i := range 3 {
+			if ok := client.Enqueue(newTestMessage("hi").Frame()); ok != (i < 2) {
+				t.Errorf("frame %d queued: %v", i, ok)
+			}
+		}
+		if frames := received(client); len(frames) != 0 {
+			t.Errorf("%d frames are written before the close frame, want none", len(frames))
+		}
+		if client.closeCode != CloseSlowConsumer {
+			t.Errorf("closed with %d, want %d", client.closeCode, CloseSlowConsumer)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		client := newClient()
+		client.Enqueue(newTestMessage("hi").Frame())
+		client.Shutdown(CloseIdle, "idle timeout")
+		if frames := received(client); len(frames) != 1 {
+			t.Errorf("%d frames are written before the close frame, want the queued one", len(frames))
+		}
+		if client.closeCode != CloseIdle {
+			t.Errorf("closed with %d, want %d", client.closeCode, CloseIdle)
+		}
+	})
+}
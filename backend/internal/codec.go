@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocols name the version of the frame schema and its encoding,
+// a version changes only when existing fields or frames change meaning.
+// New frame types and fields are added within a version and have to be
+// ignored by clients that do not know them.
+const (
+	SubprotocolV1Json = "raccoon.v1.json"
+	SubprotocolV1Cbor = "raccoon.v1.cbor"
+)
+
+// Codec encodes frames for one subprotocol
+type Codec interface {
+	Subprotocol() string
+	// MessageType is the WebSocket message type the frames are sent as
+	MessageType() int
+	Encode(frame *Frame) ([]byte, error)
+	Decode(data []byte, frame *Frame) error
+}
+
+// ChatSubprotocols lists the subprotocols in order of preference
+var ChatSubprotocols = []string{SubprotocolV1Cbor, SubprotocolV1Json}
+
+// CodecFor returns the codec of the negotiated subprotocol, JSON when none was
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolV1Cbor {
+		return cborCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return SubprotocolV1Json
+}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(frame *Frame) ([]byte, error) {
+	return json.Marshal(frame)
+}
+
+func (jsonCodec) Decode(data []byte, frame *Frame) error {
+	return json.Unmarshal(data, frame)
+}
+
+var (
+	cborEncoder = mustEncMode(cbor.EncOptions{
+		Time:    cbor.TimeUnixMicro,
+		TimeTag: cbor.EncTagRequired,
+	})
+	cborDecoder = mustDecMode(cbor.DecOptions{
+		MaxNestedLevels:  16,
+		MaxArrayElements: MaxResumeRooms * 2,
+		MaxMapPairs:      MaxResumeRooms * 2,
+	})
+)
+
+func mustEncMode(options cbor.EncOptions) cbor.EncMode {
+	mode, err := options.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+func mustDecMode(options cbor.DecOptions) cbor.DecMode {
+	mode, err := options.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}
+
+// cborCodec encodes frames as CBOR maps keyed by the small integers
+// from the cbor tags of Frame, timestamps as epoch seconds
+type cborCodec struct{}
+
+func (cborCodec) Subprotocol() string {
+	return SubprotocolV1Cbor
+}
+
+func (cborCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (cborCodec) Encode(frame *Frame) ([]byte, error) {
+	return cborEncoder.Marshal(frame)
+}
+
+func (cborCodec) Decode(data []byte, frame *Frame) error {
+	return cborDecoder.Unmarshal(data, frame)
+}
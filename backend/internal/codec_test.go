@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	// CBOR sends timestamps as floating point seconds, precise to microseconds
+	timestamp := time.Date(2024, 5, 1, 12, 30, 15, 123456000, time.UTC)
+	cursors := make(map[string]uint64, MaxResumeRooms)
+	for i := range MaxResumeRooms {
+		cursors["room-"+strconv.Itoa(i)] = uint64(i + 1)
+	}
+	rateLimited := NewRateLimitedFrame(testRoom, 1500*time.Millisecond)
+	rateLimited.Timestamp = timestamp
+	frames := []struct {
+		name  string
+		frame *Frame
+	}{
+		{
+			name: "message",
+			frame: &Frame{
+				Type:      FrameMessage,
+				Id:        "0f8fad5b-d9cb-469f-a165-70867728950e",
+				Room:      testRoom,
+				Seq:       42,
+				Body:      "hi @bob 👋",
+				Sender:    "alice",
+				ParentId:  "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+				Mentions:  []Mention{{Kind: MentionUser, Username: "bob"}, {Kind: MentionRoom}},
+				Reactions: []Reaction{{Emoji: ":tada:", Count: 2, Users: []string{"bob", "carol"}}},
+				Timestamp: timestamp,
+			},
+		},
+		{
+			name:  "resume",
+			frame: &Frame{Type: FrameResume, Cursors: cursors, Timestamp: timestamp},
+		},
+		{
+			name:  "rate limited",
+			frame: rateLimited,
+		},
+	}
+	codecs := []struct {
+		subprotocol string
+		messageType int
+	}{
+		{subprotocol: SubprotocolV1Json, messageType: websocket.TextMessage},
+		{subprotocol: SubprotocolV1Cbor, messageType: websocket.BinaryMessage},
+	}
+	for _, c := range codecs {
+		codec := CodecFor(c.subprotocol)
+		if codec.Subprotocol() != c.subprotocol || codec.MessageType() != c.messageType {
+			t.Errorf("codec for %s is %s sent as %d", c.subprotocol, codec.Subprotocol(), codec.MessageType())
+		}
+		for _, test := range frames {
+			t.Run(c.subprotocol+" "+test.name, func(t *testing.T) {
+				data, err := codec.Encode(test.frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var decoded Frame
+				if err = codec.Decode(data, &decoded); err != nil {
+					t.Fatal(err)
+				}
+				if !decoded.Timestamp.Round(time.Microsecond).Equal(test.frame.Timestamp) {
+					t.Errorf("timestamp %v, want %v", decoded.Timestamp, test.frame.Timestamp)
+				}
+				decoded.Timestamp = test.frame.Timestamp
+				if !reflect.DeepEqual(&decoded, test.frame) {
+					t.Errorf("got %+v, want %+v", &decoded, test.frame)
+				}
+			})
+		}
+	}
+}
+
+func TestCodecForFallsBackToJson(t *testing.T) {
+	for _, subprotocol := range []string{"", "raccoon", "bearer.token"} {
+		if codec := CodecFor(subprotocol); codec.Subprotocol() != SubprotocolV1Json {
+			t.Errorf("codec for %q is %s", subprotocol, codec.Subprotocol())
+		}
+	}
+}
+
+func TestCborDecodeLimits(t *testing.T) {
+	cursors := make(map[string]uint64, MaxResumeRooms*2+1)
+	for i := range MaxResumeRooms*2 + 1 {
+		cursors["room-"+strconv.Itoa(i)] = uint64(i)
+	}
+	data, err := cborEncoder.Marshal(&Frame{Type: FrameResume, Cursors: cursors})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frame Frame
+	if err = CodecFor(SubprotocolV1Cbor).Decode(data, &frame); err == nil {
+		t.Error("a frame with too many cursors was decoded")
+	}
+}
@@ -1,21 +1,85 @@
 package internal
 
 import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/go-playground/validator/v10"
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/v2"
 )
 
+// TenantConfig trusts the tokens of one issuer, every tenant has its own user pool
+type TenantConfig struct {
+	Id                     string   `koanf:"id"                       validate:"required"`
+	OpenIdConfigurationUrl string   `koanf:"openid_configuration_url" validate:"required,url"`
+	JwksUrl                string   `koanf:"jwks_url"                 validate:"omitempty,url"`
+	TokenUse               []string `koanf:"token_use"                validate:"dive,oneof=access id"`
+	ClientIds              []string `koanf:"client_ids"`
+	RequiredScopes         []string `koanf:"required_scopes"`
+	UserPoolId             string   `koanf:"user_pool_id"             validate:"required"`
+}
+
+// DefaultTenant names the tenant of the top level issuer settings,
+// which are used when TENANTS is not set
+const DefaultTenant = "default"
+
+// UserKey tells apart users of different tenants sharing a username
+func UserKey(tenant, username string) string {
+	return tenant + "\x00" + username
+}
+
 type Config struct {
-	Port                   int    `koanf:"port"                     validate:"min=1,max=65535"`
-	LogLevel               string `koanf:"log_level"                validate:"oneof=debug info warn error"`
-	ApiPathPrefix          string `koanf:"api_path_prefix"          validate:"required"`
-	WsPathPrefix           string `koanf:"ws_path_prefix"           validate:"required"`
-	OpenIdConfigurationUrl string `koanf:"openid_configuration_url" validate:"required"`
-	JwksUrl                string `koanf:"jwks_url"                 validate:"required"`
-	Region                 string `koanf:"region"                   validate:"required"`
-	UserPoolId             string `koanf:"user_pool_id"             validate:"required"`
-	AvatarsBucketName      string `koanf:"avatars_bucket_name"      validate:"required"`
+	Port                    int            `koanf:"port"                       validate:"min=1,max=65535"`
+	LogLevel                string         `koanf:"log_level"                  validate:"oneof=debug info warn error"`
+	ApiPathPrefix           string         `koanf:"api_path_prefix"            validate:"required"`
+	WsPathPrefix            string         `koanf:"ws_path_prefix"             validate:"required"`
+	Tenants                 []TenantConfig `koanf:"tenants"                    validate:"unique=Id,dive"`
+	OpenIdConfigurationUrl  string         `koanf:"openid_configuration_url"   validate:"required_without=Tenants,omitempty,url"`
+	JwksUrl                 string         `koanf:"jwks_url"                   validate:"omitempty,url"`
+	JwksMinRefreshInterval  time.Duration  `koanf:"jwks_min_refresh_interval"  validate:"min=1s"`
+	JwksRefreshInterval     time.Duration  `koanf:"jwks_refresh_interval"      validate:"gtefield=JwksMinRefreshInterval"`
+	TokenUse                []string       `koanf:"token_use"                  validate:"dive,oneof=access id"`
+	ClientIds               []string       `koanf:"client_ids"`
+	RequiredScopes          []string       `koanf:"required_scopes"`
+	Region                  string         `koanf:"region"                     validate:"required"`
+	UserPoolId              string         `koanf:"user_pool_id"               validate:"required_without=Tenants"`
+	AvatarsBucketName       string         `koanf:"avatars_bucket_name"        validate:"required"`
+	WsTicketTtl             time.Duration  `koanf:"ws_ticket_ttl"              validate:"min=1s,max=5m"`
+	WsSendQueueSize         int            `koanf:"ws_send_queue_size"         validate:"min=1"`
+	WsWriteTimeout          time.Duration  `koanf:"ws_write_timeout"           validate:"min=100ms"`
+	WsPingInterval          time.Duration  `koanf:"ws_ping_interval"           validate:"min=1s"`
+	WsPongTimeout           time.Duration  `koanf:"ws_pong_timeout"            validate:"gtfield=WsPingInterval"`
+	WsIdleTimeout           time.Duration  `koanf:"ws_idle_timeout"            validate:"min=0"`
+	WsCompression           bool           `koanf:"ws_compression"`
+	WsCompressionLevel      int            `koanf:"ws_compression_level"       validate:"min=-2,max=9"`
+	WsCompressionThreshold  int            `koanf:"ws_compression_threshold"   validate:"min=0"`
+	ShutdownDrainTimeout    time.Duration  `koanf:"shutdown_drain_timeout"     validate:"min=0"`
+	MessageStore            string         `koanf:"message_store"              validate:"oneof=memory disk redis"`
+	MessageStoreDir         string         `koanf:"message_store_dir"          validate:"required_if=MessageStore disk"`
+	MessageStoreSegmentSize int64          `koanf:"message_store_segment_size" validate:"min=4096"`
+	MessageStoreSync        string         `koanf:"message_store_sync"         validate:"oneof=always none"`
+	PresenceOfflineGrace    time.Duration  `koanf:"presence_offline_grace"     validate:"min=0"`
+	TypingTimeout           time.Duration  `koanf:"typing_timeout"             validate:"min=1s"`
+	TypingInterval          time.Duration  `koanf:"typing_interval"            validate:"min=0"`
+	TypingMaxPerSecond      int            `koanf:"typing_max_per_second"      validate:"min=1"`
+	Broker                  string         `koanf:"broker"                     validate:"oneof=memory redis"`
+	RedisUrl                string         `koanf:"redis_url"                  validate:"required_if=Broker redis,required_if=RateLimiter redis,required_if=MessageStore redis"`
+	RedisChannel            string         `koanf:"redis_channel"              validate:"required"`
+	PresenceSyncInterval    time.Duration  `koanf:"presence_sync_interval"     validate:"min=1s"`
+	RateLimiter             string         `koanf:"rate_limiter"               validate:"oneof=memory redis"`
+	RateLimitUserBurst      int            `koanf:"rate_limit_user_burst"      validate:"min=1"`
+	RateLimitUserRate       float64        `koanf:"rate_limit_user_rate"       validate:"gt=0"`
+	RateLimitRoomBurst      int            `koanf:"rate_limit_room_burst"      validate:"min=1"`
+	RateLimitRoomRate       float64        `koanf:"rate_limit_room_rate"       validate:"gt=0"`
+	ResumeMaxMessages       int            `koanf:"resume_max_messages"        validate:"min=1,ltfield=WsSendQueueSize"`
 }
 
 func (c *Config) SetDefaults() {
@@ -23,11 +87,88 @@ func (c *Config) SetDefaults() {
 	c.LogLevel = "info"
 	c.ApiPathPrefix = "/api"
 	c.WsPathPrefix = "/ws"
+	c.TokenUse = []string{"access"}
+	c.JwksMinRefreshInterval = time.Minute
+	c.JwksRefreshInterval = time.Hour
+	c.WsTicketTtl = time.Second * 30
+	c.WsSendQueueSize = 256
+	c.WsWriteTimeout = time.Second * 10
+	c.WsPingInterval = time.Second * 54
+	c.WsPongTimeout = time.Second * 60
+	c.WsIdleTimeout = time.Minute * 30
+	c.WsCompression = true
+	c.WsCompressionLevel = flate.BestSpeed
+	c.WsCompressionThreshold = 512
+	c.ShutdownDrainTimeout = time.Second * 20
+	c.MessageStore = MessageStoreMemory
+	c.PresenceOfflineGrace = time.Second * 10
+	c.TypingTimeout = time.Second * 5
+	c.TypingInterval = time.Second * 2
+	c.TypingMaxPerSecond = 5
+	c.MessageStoreSegmentSize = 16 * 1024 * 1024
+	c.MessageStoreSync = MessageStoreSyncAlways
+	c.Broker = BrokerMemory
+	c.RedisChannel = "raccoon:chat"
+	c.PresenceSyncInterval = time.Second * 30
+	c.ResumeMaxMessages = 200
+	c.RateLimiter = RateLimiterMemory
+	c.RateLimitUserBurst = 10
+	c.RateLimitUserRate = 1
+	c.RateLimitRoomBurst = 50
+	c.RateLimitRoomRate = 10
+}
+
+// TenantConfigs returns the configured tenants or the default one,
+// tenants without token_use take the top level one
+func (c *Config) TenantConfigs() []TenantConfig {
+	if len(c.Tenants) == 0 {
+		return []TenantConfig{{
+			Id:                     DefaultTenant,
+			OpenIdConfigurationUrl: c.OpenIdConfigurationUrl,
+			JwksUrl:                c.JwksUrl,
+			TokenUse:               c.TokenUse,
+			ClientIds:              c.ClientIds,
+			RequiredScopes:         c.RequiredScopes,
+			UserPoolId:             c.UserPoolId,
+		}}
+	}
+	tenants := slices.Clone(c.Tenants)
+	for i := range tenants {
+		if tenants[i].TokenUse == nil {
+			tenants[i].TokenUse = c.TokenUse
+		}
+	}
+	return tenants
 }
 
+// tenantsHook decodes TENANTS, a JSON list of tenant objects
+func tenantsHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf([]TenantConfig{}) {
+		return data, nil
+	}
+	var tenants []map[string]any
+	if strings.TrimSpace(data.(string)) == "" {
+		return tenants, nil
+	}
+	if err := json.Unmarshal([]byte(data.(string)), &tenants); err != nil {
+		return nil, fmt.Errorf("tenants: %w", err)
+	}
+	return tenants, nil
+}
+
+var errLocalStores = errors.New("BROKER=redis needs MESSAGE_STORE=redis to share rooms and messages between instances")
+
 func (c *Config) Validate() error {
 	v := validator.New()
-	return v.Struct(c)
+	if err := v.Struct(c); err != nil {
+		return err
+	}
+	// The other stores are local to the instance, so several instances would
+	// each see their own rooms and messages
+	if c.Broker == BrokerRedis && c.MessageStore != MessageStoreRedis {
+		return errLocalStores
+	}
+	return nil
 }
 
 func LoadConfig() (*Config, error) {
@@ -37,7 +178,16 @@ func LoadConfig() (*Config, error) {
 	if err := k.Load(env.Provider("", ".", nil), nil); err != nil {
 		return nil, err
 	}
-	if err := k.Unmarshal("", &cfg); err != nil {
+	// Lists are passed as comma separated values
+	decoderConfig := &mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			tenantsHook,
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			mapstructure.TextUnmarshallerHookFunc()),
+		WeaklyTypedInput: true,
+	}
+	if err := k.UnmarshalWithConf("", &cfg, koanf.UnmarshalConf{DecoderConfig: decoderConfig}); err != nil {
 		return nil, err
 	}
 	if err := cfg.Validate(); err != nil {
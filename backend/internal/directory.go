@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cognito "github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	errUnknownTenant = errors.New("unknown tenant")
+)
+
+// UserDirectory looks users up in the Cognito user pool of their tenant
+type UserDirectory struct {
+	client      *cognito.Client
+	userPoolIds map[string]string
+}
+
+func NewUserDirectory(conf *Config, awsCfg *aws.Config) *UserDirectory {
+	userPoolIds := make(map[string]string)
+	for _, tenant := range conf.TenantConfigs() {
+		userPoolIds[tenant.Id] = tenant.UserPoolId
+	}
+	return &UserDirectory{
+		client:      cognito.NewFromConfig(*awsCfg),
+		userPoolIds: userPoolIds,
+	}
+}
+
+// UserPoolId returns the user pool of the tenant
+func (d *UserDirectory) UserPoolId(tenant string) (string, error) {
+	userPoolId, ok := d.userPoolIds[tenant]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errUnknownTenant, tenant)
+	}
+	return userPoolId, nil
+}
+
+func (d *UserDirectory) GetUserAttributes(ctx context.Context, tenant, username string) (map[string]string, error) {
+	userPoolId, err := d.UserPoolId(tenant)
+	if err != nil {
+		return nil, err
+	}
+	user, err := d.client.AdminGetUser(ctx, &cognito.AdminGetUserInput{
+		UserPoolId: &userPoolId,
+		Username:   &username,
+	})
+	if err != nil {
+		var notFound *types.UserNotFoundException
+		if errors.As(err, &notFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return ToUserAttributesMap(user.UserAttributes), nil
+}
+
+func (d *UserDirectory) Exists(ctx context.Context, tenant, username string) (bool, error) {
+	_, err := d.GetUserAttributes(ctx, tenant, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const DirectRoomPrefix = "dm-"
+
+var errSelfMessage = errors.New("can not open a conversation with yourself")
+
+// DirectRoomId is the same for both orderings of the pair,
+// so either user opening the conversation ends up in the same room.
+// Pairs with the same usernames in other tenants get other rooms.
+func DirectRoomId(tenant, first, second string) string {
+	if first > second {
+		first, second = second, first
+	}
+	hash := sha256.Sum256([]byte(UserKey(tenant, first) + "\x00" + UserKey(tenant, second)))
+	return DirectRoomPrefix + hex.EncodeToString(hash[:16])
+}
+
+// DirectMessages opens 1:1 conversations, creating the room the first time
+type DirectMessages struct {
+	rooms     RoomStore
+	directory *UserDirectory
+}
+
+func NewDirectMessages(rooms RoomStore, directory *UserDirectory) *DirectMessages {
+	return &DirectMessages{
+		rooms:     rooms,
+		directory: directory,
+	}
+}
+
+func (d *DirectMessages) Open(ctx context.Context, tenant, from, to string) (*Room, error) {
+	if from == to {
+		return nil, errSelfMessage
+	}
+	id := DirectRoomId(tenant, from, to)
+	room, err := d.rooms.Get(ctx, id)
+	if err == nil {
+		return room, nil
+	}
+	if !errors.Is(err, ErrRoomNotFound) {
+		return nil, err
+	}
+	exists, err := d.directory.Exists(ctx, tenant, to)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	room = &Room{
+		Id:        id,
+		Tenant:    tenant,
+		Kind:      RoomKindDirect,
+		Private:   true,
+		CreatedBy: from,
+		CreatedAt: time.Now().UTC(),
+		Members:   map[string]Role{from: RoleMember, to: RoleMember},
+	}
+	err = d.rooms.Create(ctx, room)
+	if errors.Is(err, ErrRoomExists) {
+		return d.rooms.Get(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+type DirectMessagesRouter struct {
+	logger *zap.Logger
+	router *mux.Router
+	dms    *DirectMessages
+}
+
+func NewDirectMessagesRouter(logger *zap.Logger,
+	rootRouter *mux.Router,
+	validator *TokenValidator,
+	dms *DirectMessages) *DirectMessagesRouter {
+	router := rootRouter.PathPrefix("/dm").Subrouter()
+	router.Use(validator.ValidatingMiddleware)
+	dmRouter := &DirectMessagesRouter{logger: logger,
+		router: router,
+		dms:    dms}
+	dmRouter.registerRoutes()
+	return dmRouter
+}
+
+func (r *DirectMessagesRouter) registerRoutes() {
+	r.router.HandleFunc("/{username}", r.OpenConversation).Methods("POST")
+}
+
+func (r *DirectMessagesRouter) OpenConversation(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	room, err := r.dms.Open(req.Context(), GetTenant(req), username, mux.Vars(req)["username"])
+	if err != nil {
+		switch {
+		case errors.Is(err, errSelfMessage):
+			WriteString(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, ErrUserNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			r.logger.Error("failed to open conversation", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	WriteJSON(w, room, http.StatusOK)
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"time"
+)
+
+const (
+	FrameJoin     = "join"
+	FrameLeave    = "leave"
+	FrameMessage  = "message"
+	FrameError    = "error"
+	FrameAuth     = "auth"
+	FramePresence = "presence"
+	// Edits and deletions are sent by clients and echoed to the room with the new body
+	FrameMessageEdit   = "message.edit"
+	FrameMessageDelete = "message.delete"
+	// Reactions carry the emoji or :shortcode: in the body and the aggregated reactions of the message
+	FrameReactionAdd    = "reaction.add"
+	FrameReactionRemove = "reaction.remove"
+	// Mentions are sent to the mentioned users whether or not they have joined the room
+	FrameMention = "mention"
+	// Resume carries the last sequence number the client saw per room, the server
+	// replays what was missed and answers with a resume frame per room, or with
+	// resume.gap when too much was missed and the client has to use history instead
+	FrameResume    = "resume"
+	FrameResumeGap = "resume.gap"
+	// Read receipts carry the highest sequence number the sender has seen in the room
+	FrameRead = "read"
+	// Typing indicators expire on the server unless refreshed by another start
+	FrameTypingStart = "typing.start"
+	FrameTypingStop  = "typing.stop"
+)
+
+// clientFrameTypes are the frames clients may send, auth frames are handled by the client
+var clientFrameTypes = []string{
+	FrameJoin,
+	FrameLeave,
+	FramePresence,
+	FrameResume,
+	FrameMessage,
+	FrameMessageEdit,
+	FrameMessageDelete,
+	FrameReactionAdd,
+	FrameReactionRemove,
+	FrameRead,
+	FrameTypingStart,
+	FrameTypingStop,
+}
+
+// Frame is the unit of the chat protocol, the cbor keys are part of
+// the v1 schema and must never be reused for another field.
+// Code is only set on error frames, RetryAfter on rate_limited errors
+// as the number of milliseconds to wait before sending again.
+type Frame struct {
+	Type       string            `json:"type"                  cbor:"1,keyasint"`
+	Id         string            `json:"id,omitempty"          cbor:"2,keyasint,omitempty"`
+	Room       string            `json:"room,omitempty"        cbor:"3,keyasint,omitempty"`
+	To         string            `json:"to,omitempty"          cbor:"4,keyasint,omitempty"`
+	Seq        uint64            `json:"seq,omitempty"         cbor:"5,keyasint,omitempty"`
+	Body       string            `json:"body,omitempty"        cbor:"6,keyasint,omitempty"`
+	Sender     string            `json:"sender,omitempty"      cbor:"7,keyasint,omitempty"`
+	ParentId   string            `json:"parent_id,omitempty"   cbor:"8,keyasint,omitempty"`
+	Mentions   []Mention         `json:"mentions,omitempty"    cbor:"9,keyasint,omitempty"`
+	Reactions  []Reaction        `json:"reactions,omitempty"   cbor:"10,keyasint,omitempty"`
+	Cursors    map[string]uint64 `json:"cursors,omitempty"     cbor:"11,keyasint,omitempty"`
+	Timestamp  time.Time         `json:"timestamp"             cbor:"12,keyasint"`
+	Code       string            `json:"code,omitempty"        cbor:"13,keyasint,omitempty"`
+	RetryAfter int64             `json:"retry_after,omitempty" cbor:"14,keyasint,omitempty"`
+}
+
+// Error codes tell clients what went wrong, the body is meant for people
+const (
+	ErrorMalformedFrame   = "malformed_frame"
+	ErrorUnknownFrameType = "unknown_frame_type"
+	ErrorInvalidRoom      = "invalid_room"
+	ErrorInvalidRequest   = "invalid_request"
+	ErrorInvalidToken     = "invalid_token"
+	ErrorForbidden        = "forbidden"
+	ErrorNotFound         = "not_found"
+	ErrorInternal         = "internal"
+	ErrorRateLimited      = "rate_limited"
+)
+
+func NewErrorFrame(room, code, message string) *Frame {
+	return &Frame{
+		Type:      FrameError,
+		Room:      room,
+		Code:      code,
+		Body:      message,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func NewRateLimitedFrame(room string, retryAfter time.Duration) *Frame {
+	frame := NewErrorFrame(room, ErrorRateLimited, "rate limited")
+	frame.RetryAfter = max(retryAfter.Milliseconds(), 1)
+	return frame
+}
@@ -3,5 +3,6 @@ package internal
 const (
 	HeaderAuthorization = "Authorization"
 	HeaderContentType   = "Content-Type"
+	HeaderRetryAfter    = "Retry-After"
 	ContentTypeJSON     = "application/json"
 )
@@ -0,0 +1,786 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	MaxRoomIdLength = 128
+	MaxResumeRooms  = 100
+	storeTimeout    = 5 * time.Second
+)
+
+type Hub struct {
+	config    *Config
+	logger    *zap.Logger
+	store     MessageStore
+	roomStore RoomStore
+	dms       *DirectMessages
+	presence  *PresenceTracker
+	typing    *TypingTracker
+	receipts  ReceiptStore
+	mentions  MentionStore
+	broker    Broker
+	limiter   RateLimiter
+	instance  string
+	streams   *StreamRegistry
+	mutex     sync.RWMutex
+	rooms     map[string]map[*Client]struct{}
+	// users holds the connections by UserKey
+	users map[string]map[*Client]struct{}
+	// draining is set once the server shuts down, new connections are turned away
+	draining    bool
+	connections sync.WaitGroup
+}
+
+func NewHub(config *Config,
+	logger *zap.Logger,
+	store MessageStore,
+	roomStore RoomStore,
+	dms *DirectMessages,
+	presence *PresenceTracker,
+	typing *TypingTracker,
+	receipts ReceiptStore,
+	mentions MentionStore,
+	broker Broker,
+	limiter RateLimiter) (*Hub, error) {
+	instance := uuid.NewString()
+	hub := &Hub{
+		config:    config,
+		logger:    logger,
+		store:     store,
+		roomStore: roomStore,
+		dms:       dms,
+		presence:  presence,
+		typing:    typing,
+		receipts:  receipts,
+		mentions:  mentions,
+		broker:    broker,
+		limiter:   limiter,
+		instance:  instance,
+		streams:   NewStreamRegistry(instance),
+		rooms:     make(map[string]map[*Client]struct{}),
+		users:     make(map[string]map[*Client]struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := broker.Subscribe(ctx, hub.dispatch); err != nil {
+		return nil, err
+	}
+	presence.OnChange(hub.publishPresence)
+	typing.OnExpire(hub.expireTyping)
+	return hub, nil
+}
+
+func (h *Hub) Register(c *Client) {
+	h.mutex.Lock()
+	clients, ok := h.users[c.userKey()]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		h.users[c.userKey()] = clients
+	}
+	clients[c] = struct{}{}
+	h.connections.Add(1)
+	draining := h.draining
+	h.mutex.Unlock()
+	h.presence.Connect(c)
+	// The upgrade raced with Drain
+	if draining {
+		c.Shutdown(websocket.CloseGoingAway, goingAwayReason)
+	}
+}
+
+func (h *Hub) Join(c *Client, room string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	clients, ok := h.rooms[room]
+	if !ok {
+		clients = make(map[*Client]struct{})
+		h.rooms[room] = clients
+	}
+	clients[c] = struct{}{}
+	c.rooms[room] = struct{}{}
+}
+
+func (h *Hub) Leave(c *Client, room string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.leave(c, room)
+}
+
+func (h *Hub) leave(c *Client, room string) {
+	delete(c.rooms, room)
+	clients, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.mutex.Lock()
+	for room := range c.rooms {
+		h.leave(c, room)
+	}
+	if clients, ok := h.users[c.userKey()]; ok {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(h.users, c.userKey())
+		}
+	}
+	h.mutex.Unlock()
+	h.presence.Disconnect(c)
+	c.Close()
+	h.connections.Done()
+}
+
+// Drain turns new connections away and asks every connected client
+// to reconnect, the connections close once their queues are written
+func (h *Hub) Drain() {
+	h.mutex.Lock()
+	h.draining = true
+	var clients []*Client
+	for _, connections := range h.users {
+		for client := range connections {
+			clients = append(clients, client)
+		}
+	}
+	h.mutex.Unlock()
+	h.logger.Info("draining chat connections", zap.Int("connections", len(clients)))
+	for _, client := range clients {
+		client.Shutdown(websocket.CloseGoingAway, goingAwayReason)
+	}
+}
+
+func (h *Hub) Draining() bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.draining
+}
+
+// Wait blocks until every connection is closed or the context is done
+func (h *Hub) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Evict detaches every connection of a user who is no longer a member of the room
+func (h *Hub) Evict(room *Room, username string) {
+	h.publish(&Envelope{Kind: EnvelopeEvict, Room: room.Id, Tenant: room.Tenant, Users: []string{username}})
+}
+
+func (h *Hub) evict(room, tenant, username string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.users[UserKey(tenant, username)] {
+		if _, ok := client.rooms[room]; ok {
+			h.leave(client, room)
+			client.Enqueue(&Frame{Type: FrameLeave, Room: room, Timestamp: time.Now().UTC()})
+		}
+	}
+}
+
+// authorize checks the sender's role in the room before any chat operation,
+// rooms of other tenants are treated as missing
+func (h *Hub) authorize(c *Client, roomId string, permission Permission) (*Room, bool) {
+	return h.authorizeUser(c.tenant, c.username, roomId, permission)
+}
+
+func (h *Hub) authorizeUser(tenant, username, roomId string, permission Permission) (*Room, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	room, err := h.roomStore.Get(ctx, roomId)
+	if err != nil {
+		if !errors.Is(err, ErrRoomNotFound) {
+			h.logger.Error("failed to load room", zap.String("room", roomId), zap.Error(err))
+		}
+		return nil, false
+	}
+	if room.Tenant != tenant {
+		return nil, false
+	}
+	return room, room.Can(username, permission)
+}
+
+// Throttle takes a token for the frame from the bucket of the user and, when they
+// are a member, from the bucket of the room. When either is empty it returns false
+// with the time to wait. Frames are let through when the limiter fails.
+func (h *Hub) Throttle(tenant, username string, frame *Frame) (bool, time.Duration) {
+	if !slices.Contains(rateLimitedFrames, frame.Type) {
+		return true, 0
+	}
+	userLimit := RateLimit{Burst: h.config.RateLimitUserBurst, Rate: h.config.RateLimitUserRate}
+	if ok, wait := h.allow("user:"+UserKey(tenant, username), userLimit); !ok {
+		return false, wait
+	}
+	if frame.Room == "" || len(frame.Room) > MaxRoomIdLength {
+		return true, 0
+	}
+	// Only members use up the budget of the room, the frames of others are turned away later
+	if _, ok := h.authorizeUser(tenant, username, frame.Room, PermissionRead); !ok {
+		return true, 0
+	}
+	roomLimit := RateLimit{Burst: h.config.RateLimitRoomBurst, Rate: h.config.RateLimitRoomRate}
+	return h.allow("room:"+frame.Room, roomLimit)
+}
+
+func (h *Hub) allow(key string, limit RateLimit) (bool, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	ok, wait, err := h.limiter.Allow(ctx, key, limit)
+	if err != nil {
+		h.logger.Warn("rate limiter failed", zap.String("key", key), zap.Error(err))
+		return true, 0
+	}
+	if !ok {
+		metricFramesThrottled.Add(1)
+	}
+	return ok, wait
+}
+
+// openDirect resolves the "to" field of a frame into the conversation room
+func (h *Hub) openDirect(c *Client, frame *Frame) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	room, err := h.dms.Open(ctx, c.tenant, c.username, frame.To)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			c.Enqueue(NewErrorFrame("", ErrorNotFound, err.Error()))
+		case errors.Is(err, errSelfMessage):
+			c.Enqueue(NewErrorFrame("", ErrorInvalidRequest, err.Error()))
+		default:
+			h.logger.Error("failed to open conversation", zap.Error(err))
+			c.Enqueue(NewErrorFrame("", ErrorInternal, "conversation not available"))
+		}
+		return false
+	}
+	frame.Room = room.Id
+	return true
+}
+
+// publish hands the envelope to the broker, which passes it to dispatch on every instance
+func (h *Hub) publish(envelope *Envelope) {
+	envelope.Instance = h.instance
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := h.broker.Publish(ctx, envelope); err != nil {
+		h.logger.Error("failed to publish chat event", zap.String("kind", envelope.Kind), zap.Error(err))
+	}
+}
+
+// dispatch delivers an envelope to the connections of this instance
+func (h *Hub) dispatch(envelope *Envelope) {
+	switch envelope.Kind {
+	case EnvelopeRoom:
+		h.broadcast(envelope.Room, envelope.Frame, envelope.Except)
+	case EnvelopeUsers:
+		h.sendToUsers(envelope.Tenant, envelope.Users, envelope.Frame)
+	case EnvelopeEvict:
+		for _, username := range envelope.Users {
+			h.evict(envelope.Room, envelope.Tenant, username)
+		}
+	case EnvelopePresence:
+		if envelope.Presence == nil {
+			return
+		}
+		presence, changed := h.presence.Merge(envelope.Instance, *envelope.Presence, time.Now())
+		if changed {
+			h.notifyPresence(presence)
+		}
+	case EnvelopeStream:
+		h.streams.post(envelope.Stream, envelope.Tenant, envelope.User, envelope.Frame)
+	}
+}
+
+// SendToUsers delivers a frame to every connection of the users of the tenant,
+// whether or not they have joined the room
+func (h *Hub) SendToUsers(tenant string, usernames []string, frame *Frame) {
+	h.publish(&Envelope{Kind: EnvelopeUsers, Tenant: tenant, Users: usernames, Frame: frame})
+}
+
+// ForwardToStream hands a frame posted for an SSE stream of another instance to
+// that instance
+func (h *Hub) ForwardToStream(stream, tenant, username string, frame *Frame) {
+	h.publish(&Envelope{
+		Kind:   EnvelopeStream,
+		Stream: stream,
+		Tenant: tenant,
+		User:   username,
+		Frame:  frame,
+	})
+}
+
+func (h *Hub) sendToUsers(tenant string, usernames []string, frame *Frame) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, username := range usernames {
+		for client := range h.users[UserKey(tenant, username)] {
+			client.Enqueue(frame)
+		}
+	}
+}
+
+// deliver fans a frame out to the room, except for the connections of one user.
+// Direct conversations reach both participants even before they have joined.
+func (h *Hub) deliver(room *Room, frame *Frame, except string) {
+	if room.IsDirect() {
+		recipients := maps.Clone(room.Members)
+		delete(recipients, except)
+		h.SendToUsers(room.Tenant, slices.Collect(maps.Keys(recipients)), frame)
+		return
+	}
+	h.publish(&Envelope{Kind: EnvelopeRoom, Room: room.Id, Except: except, Frame: frame})
+}
+
+func (h *Hub) Broadcast(room string, frame *Frame) {
+	h.publish(&Envelope{Kind: EnvelopeRoom, Room: room, Frame: frame})
+}
+
+func (h *Hub) broadcast(room string, frame *Frame, except string) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for client := range h.rooms[room] {
+		if client.username == except {
+			continue
+		}
+		client.Enqueue(frame)
+	}
+}
+
+func (h *Hub) HandleFrame(c *Client, frame *Frame) {
+	if !slices.Contains(clientFrameTypes, frame.Type) {
+		c.Enqueue(NewErrorFrame(frame.Room, ErrorUnknownFrameType, "unknown frame type"))
+		return
+	}
+	if frame.Type == FrameMessage && frame.Room == "" && frame.To != "" {
+		if !h.openDirect(c, frame) {
+			return
+		}
+	}
+	roomless := frame.Type == FramePresence || frame.Type == FrameResume
+	if !roomless && (frame.Room == "" || len(frame.Room) > MaxRoomIdLength) {
+		c.Enqueue(NewErrorFrame(frame.Room, ErrorInvalidRoom, "invalid room"))
+		return
+	}
+	switch frame.Type {
+	case FrameJoin:
+		if _, ok := h.authorize(c, frame.Room, PermissionRead); !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not a member of the room"))
+			return
+		}
+		h.Join(c, frame.Room)
+	case FrameLeave:
+		h.Leave(c, frame.Room)
+	case FramePresence:
+		h.setPresence(c, frame)
+	case FrameResume:
+		h.resume(c, frame.Cursors)
+	case FrameMessage:
+		room, ok := h.authorize(c, frame.Room, PermissionPost)
+		if !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not allowed to post in the room"))
+			return
+		}
+		h.publishMessage(c, room, frame)
+	case FrameMessageEdit, FrameMessageDelete:
+		room, ok := h.authorize(c, frame.Room, PermissionRead)
+		if !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not a member of the room"))
+			return
+		}
+		h.changeMessage(c, room, frame)
+	case FrameReactionAdd, FrameReactionRemove:
+		room, ok := h.authorize(c, frame.Room, PermissionPost)
+		if !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not allowed to post in the room"))
+			return
+		}
+		h.react(c, room, frame)
+	case FrameRead:
+		room, ok := h.authorize(c, frame.Room, PermissionRead)
+		if !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not a member of the room"))
+			return
+		}
+		h.markRead(c, room, frame.Seq)
+	case FrameTypingStart, FrameTypingStop:
+		room, ok := h.authorize(c, frame.Room, PermissionPost)
+		if !ok {
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorForbidden, "not allowed to post in the room"))
+			return
+		}
+		h.publishTyping(c.username, room, frame.Type)
+	}
+}
+
+// resume joins the rooms and replays the messages after each cursor
+func (h *Hub) resume(c *Client, cursors map[string]uint64) {
+	if len(cursors) > MaxResumeRooms {
+		c.Enqueue(NewErrorFrame("", ErrorInvalidRequest, "too many rooms to resume"))
+		return
+	}
+	for _, roomId := range slices.Sorted(maps.Keys(cursors)) {
+		room, ok := h.authorize(c, roomId, PermissionRead)
+		if !ok {
+			c.Enqueue(NewErrorFrame(roomId, ErrorForbidden, "not a member of the room"))
+			continue
+		}
+		h.resumeRoom(c, room, cursors[roomId])
+	}
+}
+
+// resumeRoom holds back live frames until the replay is queued so none of them
+// overtakes the replay or gets lost between reading the store and joining
+func (h *Hub) resumeRoom(c *Client, room *Room, after uint64) {
+	c.Hold(room.Id)
+	h.Join(c, room.Id)
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	last, err := h.store.LastSeq(ctx, room.Id)
+	if err != nil {
+		h.logger.Error("failed to load last sequence number", zap.Error(err))
+		c.Release(room.Id, []*Frame{NewErrorFrame(room.Id, ErrorInternal, "resume failed")}, 0)
+		return
+	}
+	now := time.Now().UTC()
+	if after > last || last-after > uint64(h.config.ResumeMaxMessages) {
+		gap := &Frame{Type: FrameResumeGap, Room: room.Id, Seq: last, Timestamp: now}
+		c.Release(room.Id, []*Frame{gap}, 0)
+		return
+	}
+	messages, err := h.store.Since(ctx, room.Id, after, h.config.ResumeMaxMessages)
+	if err != nil {
+		h.logger.Error("failed to load missed messages", zap.Error(err))
+		c.Release(room.Id, []*Frame{NewErrorFrame(room.Id, ErrorInternal, "resume failed")}, 0)
+		return
+	}
+	replay := make([]*Frame, 0, len(messages)+1)
+	replayed := after
+	for _, message := range messages {
+		frame := message.Frame()
+		if message.Deleted {
+			frame.Type = FrameMessageDelete
+			frame.Sender = message.DeletedBy
+		}
+		replay = append(replay, frame)
+		replayed = message.Seq
+	}
+	replay = append(replay, &Frame{Type: FrameResume, Room: room.Id, Seq: replayed, Timestamp: now})
+	c.Release(room.Id, replay, replayed)
+}
+
+func (h *Hub) publishMessage(c *Client, room *Room, frame *Frame) {
+	if err := ValidateBody(frame.Body); err != nil {
+		c.Enqueue(NewErrorFrame(room.Id, ErrorInvalidRequest, err.Error()))
+		return
+	}
+	message := &Message{
+		Id:        uuid.NewString(),
+		Room:      frame.Room,
+		Body:      frame.Body,
+		Sender:    c.username,
+		Timestamp: time.Now().UTC(),
+		Mentions:  ParseMentions(frame.Body, room),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if frame.ParentId != "" {
+		parentId, err := h.threadRoot(ctx, room.Id, frame.ParentId)
+		if err != nil {
+			if !errors.Is(err, ErrMessageNotFound) && !errors.Is(err, ErrMessageDeleted) {
+				h.logger.Error("failed to load thread parent", zap.Error(err))
+				c.Enqueue(NewErrorFrame(frame.Room, ErrorInternal, "message not stored"))
+				return
+			}
+			c.Enqueue(NewErrorFrame(frame.Room, ErrorNotFound, err.Error()))
+			return
+		}
+		message.ParentId = parentId
+	}
+	if err := h.store.Append(ctx, message); err != nil {
+		h.logger.Error("failed to store chat message", zap.Error(err))
+		c.Enqueue(NewErrorFrame(frame.Room, ErrorInternal, "message not stored"))
+		return
+	}
+	if message.ParentId != "" {
+		_, err := h.store.Update(ctx, room.Id, message.ParentId, func(parent *Message) error {
+			parent.ReplyCount++
+			parent.LastReplyAt = message.Timestamp
+			return nil
+		})
+		if err != nil {
+			h.logger.Error("failed to update thread parent", zap.Error(err))
+		}
+	}
+	h.deliver(room, message.Frame(), "")
+	h.notifyMentions(ctx, room, message, MentionedUsers(message.Mentions, room, c.username))
+	// Own messages never count as unread
+	if _, err := h.receipts.MarkRead(ctx, room.Id, c.tenant, c.username, message.Seq); err != nil {
+		h.logger.Error("failed to store read receipt", zap.Error(err))
+	}
+	if h.typing.Stop(room.Id, c.tenant, c.username, false) {
+		h.deliver(room, newTypingFrame(FrameTypingStop, room.Id, c.username), c.username)
+	}
+}
+
+// threadRoot resolves the parent of a reply, replies to replies
+// go to the thread of the top-level message
+func (h *Hub) threadRoot(ctx context.Context, room, id string) (string, error) {
+	parent, err := h.store.Get(ctx, room, id)
+	if err != nil {
+		return "", err
+	}
+	if parent.Deleted {
+		return "", ErrMessageDeleted
+	}
+	if parent.ParentId != "" {
+		return parent.ParentId, nil
+	}
+	return parent.Id, nil
+}
+
+// changeMessage edits or deletes a message on behalf of its author or a moderator
+func (h *Hub) changeMessage(c *Client, room *Room, frame *Frame) {
+	if frame.Type == FrameMessageEdit {
+		if err := ValidateBody(frame.Body); err != nil {
+			c.Enqueue(NewErrorFrame(room.Id, ErrorInvalidRequest, err.Error()))
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	// Only users mentioned for the first time by an edit are notified
+	var mentioned []string
+	message, err := h.store.Update(ctx, room.Id, frame.Id, func(message *Message) error {
+		if message.Deleted {
+			return ErrMessageDeleted
+		}
+		author := message.Sender == c.username && room.Can(c.username, PermissionPost)
+		if !author && !room.Can(c.username, PermissionModerate) {
+			return errForbidden
+		}
+		if frame.Type == FrameMessageEdit {
+			previous := MentionedUsers(message.Mentions, room, message.Sender)
+			message.Edit(frame.Body, now)
+			message.Mentions = ParseMentions(frame.Body, room)
+			mentioned = slices.DeleteFunc(MentionedUsers(message.Mentions, room, message.Sender),
+				func(username string) bool {
+					return slices.Contains(previous, username)
+				})
+		} else {
+			message.Delete(c.username, now)
+		}
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrMessageDeleted):
+			c.Enqueue(NewErrorFrame(room.Id, ErrorNotFound, err.Error()))
+		case errors.Is(err, errForbidden):
+			c.Enqueue(NewErrorFrame(room.Id, ErrorForbidden, "not allowed to change the message"))
+		default:
+			h.logger.Error("failed to update chat message", zap.Error(err))
+			c.Enqueue(NewErrorFrame(room.Id, ErrorInternal, "message not stored"))
+		}
+		return
+	}
+	h.deliver(room, &Frame{
+		Type:      frame.Type,
+		Id:        message.Id,
+		Room:      room.Id,
+		Seq:       message.Seq,
+		Body:      message.Body,
+		Sender:    c.username,
+		Mentions:  message.Mentions,
+		Timestamp: now,
+	}, "")
+	h.notifyMentions(ctx, room, message, mentioned)
+}
+
+// notifyMentions records the mention for later and sends it to every connection of the users
+func (h *Hub) notifyMentions(ctx context.Context, room *Room, message *Message, usernames []string) {
+	if len(usernames) == 0 {
+		return
+	}
+	record := MentionRecord{Room: room.Id, MessageId: message.Id, Timestamp: message.Timestamp}
+	if err := h.mentions.Add(ctx, room.Tenant, usernames, record); err != nil {
+		h.logger.Error("failed to store mentions", zap.Error(err))
+	}
+	frame := message.Frame()
+	frame.Type = FrameMention
+	h.SendToUsers(room.Tenant, usernames, frame)
+}
+
+func (h *Hub) react(c *Client, room *Room, frame *Frame) {
+	if !ValidReaction(frame.Body) {
+		c.Enqueue(NewErrorFrame(room.Id, ErrorInvalidRequest, ErrInvalidReaction.Error()))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	message, err := h.store.Update(ctx, room.Id, frame.Id, func(message *Message) error {
+		if message.Deleted {
+			return ErrMessageDeleted
+		}
+		if frame.Type == FrameReactionAdd {
+			return message.React(c.username, frame.Body)
+		}
+		return message.Unreact(c.username, frame.Body)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errReactionUnchanged):
+		case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrMessageDeleted):
+			c.Enqueue(NewErrorFrame(room.Id, ErrorNotFound, err.Error()))
+		case errors.Is(err, ErrTooManyReactions):
+			c.Enqueue(NewErrorFrame(room.Id, ErrorInvalidRequest, err.Error()))
+		default:
+			h.logger.Error("failed to update reactions", zap.Error(err))
+			c.Enqueue(NewErrorFrame(room.Id, ErrorInternal, "reaction not stored"))
+		}
+		return
+	}
+	h.deliver(room, &Frame{
+		Type:      frame.Type,
+		Id:        message.Id,
+		Room:      room.Id,
+		Seq:       message.Seq,
+		Body:      frame.Body,
+		Sender:    c.username,
+		Reactions: message.Reactions,
+		Timestamp: time.Now().UTC(),
+	}, "")
+}
+
+func newTypingFrame(frameType, room, username string) *Frame {
+	return &Frame{
+		Type:      frameType,
+		Room:      room,
+		Sender:    username,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func (h *Hub) publishTyping(username string, room *Room, frameType string) {
+	var forward bool
+	if frameType == FrameTypingStart {
+		forward = h.typing.Start(room.Id, room.Tenant, username)
+	} else {
+		forward = h.typing.Stop(room.Id, room.Tenant, username, true)
+	}
+	if forward {
+		h.deliver(room, newTypingFrame(frameType, room.Id, username), username)
+	}
+}
+
+func (h *Hub) expireTyping(roomId, username string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	room, err := h.roomStore.Get(ctx, roomId)
+	if err != nil {
+		return
+	}
+	h.deliver(room, newTypingFrame(FrameTypingStop, roomId, username), username)
+}
+
+func (h *Hub) setPresence(c *Client, frame *Frame) {
+	status := PresenceStatus(frame.Body)
+	if status != PresenceOnline && status != PresenceAway {
+		c.Enqueue(NewErrorFrame("", ErrorInvalidRequest, "invalid presence status"))
+		return
+	}
+	h.presence.SetStatus(c, status)
+}
+
+// publishPresence reports a change of the presence on this instance to all instances
+func (h *Hub) publishPresence(presence Presence) {
+	h.publish(&Envelope{Kind: EnvelopePresence, Presence: &presence})
+}
+
+// SyncPresence periodically repeats the presence reports of this instance,
+// reports that stop being repeated expire on the other instances
+func (h *Hub) SyncPresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, presence := range h.presence.Local() {
+			h.publishPresence(presence)
+		}
+		for _, presence := range h.presence.Prune(3*interval, time.Now()) {
+			h.notifyPresence(presence)
+		}
+	}
+}
+
+// notifyPresence tells the local connections of everyone sharing a room with the user
+func (h *Hub) notifyPresence(presence Presence) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	rooms, err := h.roomStore.MemberOf(ctx, presence.Tenant, presence.Username)
+	if err != nil {
+		h.logger.Error("failed to list rooms for presence", zap.Error(err))
+		return
+	}
+	recipients := make(map[string]struct{})
+	for _, room := range rooms {
+		for member := range room.Members {
+			recipients[member] = struct{}{}
+		}
+	}
+	delete(recipients, presence.Username)
+	h.sendToUsers(presence.Tenant, slices.Collect(maps.Keys(recipients)), &Frame{
+		Type:      FramePresence,
+		Sender:    presence.Username,
+		Body:      string(presence.Status),
+		Timestamp: presence.LastSeen,
+	})
+}
+
+func (h *Hub) markRead(c *Client, room *Room, seq uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	last, err := h.store.LastSeq(ctx, room.Id)
+	if err != nil {
+		h.logger.Error("failed to load last sequence number", zap.Error(err))
+		return
+	}
+	seq = min(seq, last)
+	advanced, err := h.receipts.MarkRead(ctx, room.Id, c.tenant, c.username, seq)
+	if err != nil {
+		h.logger.Error("failed to store read receipt", zap.Error(err))
+		c.Enqueue(NewErrorFrame(room.Id, ErrorInternal, "receipt not stored"))
+		return
+	}
+	if advanced {
+		h.deliver(room, &Frame{
+			Type:      FrameRead,
+			Room:      room.Id,
+			Seq:       seq,
+			Sender:    c.username,
+			Timestamp: time.Now().UTC(),
+		}, "")
+	}
+}
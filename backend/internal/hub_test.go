@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testHub struct {
+	*Hub
+	store MessageStore
+	rooms RoomStore
+}
+
+func newTestHub(t *testing.T) *testHub {
+	t.Helper()
+	config := &Config{}
+	config.SetDefaults()
+	return newConfiguredHub(t, config, NewMemoryBroker())
+}
+
+// newConfiguredHub builds a hub on the stores of the config
+func newConfiguredHub(t *testing.T, config *Config, broker Broker) *testHub {
+	t.Helper()
+	logger := zap.NewNop()
+	store, err := NewMessageStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ignore(store.Close) })
+	rooms, err := NewRoomStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts, err := NewReceiptStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mentions, err := NewMentionStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub, err := NewHub(config,
+		logger,
+		store,
+		rooms,
+		NewDirectMessages(rooms, nil),
+		NewPresenceTracker(config.PresenceOfflineGrace),
+		NewTypingTracker(config.TypingTimeout, config.TypingInterval, config.TypingMaxPerSecond),
+		receipts,
+		mentions,
+		broker,
+		NewMemoryRateLimiter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testHub{Hub: hub, store: store, rooms: rooms}
+}
+
+// connect registers a client without a connection, its frames stay in the send queue
+func (h *testHub) connect(t *testing.T, tenant, username string) *Client {
+	t.Helper()
+	client := NewClient(h.Hub, nil, username, tenant, time.Now().Add(time.Hour), nil, zap.NewNop())
+	h.Register(client)
+	t.Cleanup(func() {
+		client.Close()
+		h.Unregister(client)
+	})
+	return client
+}
+
+func (h *testHub) createRoom(t *testing.T, id string, members ...string) {
+	t.Helper()
+	room := &Room{Id: id, Tenant: DefaultTenant, Name: id, Members: make(map[string]Role)}
+	for _, member := range members {
+		room.Members[member] = RoleMember
+	}
+	if err := h.rooms.Create(context.Background(), room); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (h *testHub) appendMessages(t *testing.T, room string, count int) {
+	t.Helper()
+	for range count {
+		message := newTestMessage("missed")
+		message.Room = room
+		if err := h.store.Append(context.Background(), message); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// received takes the frames queued for the client
+func received(client *Client) []*Frame {
+	var frames []*Frame
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok {
+				return frames
+			}
+			frames = append(frames, frame)
+		default:
+			return frames
+		}
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// queued frames are waiting in the send queue when the resume comes in
+		queued   int
+		missed   int
+		replayed int
+		last     string
+	}{
+		{name: "everything missed", missed: 150, replayed: 150, last: FrameResume},
+		{name: "nothing missed", missed: 0, replayed: 0, last: FrameResume},
+		{name: "more than the replay limit", missed: 300, replayed: 0, last: FrameResumeGap},
+		{name: "replay longer than the free queue", queued: 200, missed: 150, replayed: 55, last: FrameResumeGap},
+		{name: "full queue", queued: 255, missed: 150, replayed: 0, last: FrameResumeGap},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := newTestHub(t)
+			hub.createRoom(t, testRoom, "alice")
+			hub.appendMessages(t, testRoom, test.missed)
+			client := hub.connect(t, DefaultTenant, "alice")
+			received(client)
+			for range test.queued {
+				client.Enqueue(&Frame{Type: FramePresence})
+			}
+			hub.HandleFrame(client, &Frame{Type: FrameResume, Cursors: map[string]uint64{testRoom: 0}})
+
+			frames := received(client)[test.queued:]
+			if client.closed {
+				t.Fatalf("client closed with %d %q", client.closeCode, client.closeReason)
+			}
+			if len(frames) != test.replayed+1 {
+				t.Fatalf("%d frames, want %d replayed and one more", len(frames), test.replayed)
+			}
+			for i, frame := range frames[:test.replayed] {
+				if frame.Type != FrameMessage || frame.Seq != uint64(i+1) {
+					t.Fatalf("frame %d is %s %d, want message %d", i, frame.Type, frame.Seq, i+1)
+				}
+			}
+			last := frames[len(frames)-1]
+			if last.Type != test.last {
+				t.Errorf("last frame %s, want %s", last.Type, test.last)
+			}
+			if last.Type == FrameResumeGap && last.Seq != uint64(test.missed) {
+				t.Errorf("gap up to %d, want %d", last.Seq, test.missed)
+			}
+		})
+	}
+}
+
+func TestHubKeepsTenantsApart(t *testing.T) {
+	hub := newTestHub(t)
+	hub.createRoom(t, testRoom, "alice", "bob")
+	alice := hub.connect(t, DefaultTenant, "alice")
+	bob := hub.connect(t, DefaultTenant, "bob")
+	// Another user named alice, signed in with the user pool of another tenant
+	other := hub.connect(t, "acme", "alice")
+	hub.HandleFrame(alice, &Frame{Type: FrameJoin, Room: testRoom})
+	hub.HandleFrame(bob, &Frame{Type: FrameJoin, Room: testRoom})
+	received(alice)
+	received(bob)
+	received(other)
+
+	for _, frameType := range []string{FrameJoin, FrameMessage, FrameRead, FrameTypingStart} {
+		hub.HandleFrame(other, &Frame{Type: frameType, Room: testRoom, Body: "hi"})
+		frames := received(other)
+		if len(frames) != 1 || frames[0].Code != ErrorForbidden {
+			t.Errorf("%s in the room of another tenant answered with %+v", frameType, frames)
+		}
+	}
+
+	hub.HandleFrame(bob, &Frame{Type: FrameMessage, Room: testRoom, Body: "hello @alice"})
+	if frames := received(alice); len(frames) != 2 || frames[1].Type != FrameMention {
+		t.Errorf("alice got %+v, want the message and the mention", frames)
+	}
+	if frames := received(other); len(frames) != 0 {
+		t.Errorf("alice of the other tenant got %+v", frames)
+	}
+	mentions, err := hub.mentions.List(context.Background(), "acme", "alice", HistoryQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mentions) != 0 {
+		t.Errorf("alice of the other tenant has mentions %+v", mentions)
+	}
+
+	if status := hub.presence.Get(DefaultTenant, "bob").Status; status != PresenceOnline {
+		t.Errorf("bob is %s, want online", status)
+	}
+	if status := hub.presence.Get("acme", "bob").Status; status != PresenceOffline {
+		t.Errorf("bob of the other tenant is %s, want offline", status)
+	}
+	if DirectRoomId(DefaultTenant, "alice", "bob") == DirectRoomId("acme", "alice", "bob") {
+		t.Error("direct conversations of both tenants share a room")
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// Issuer is a trusted token issuer of a tenant, with its own
+// discovery document, keys and claim rules
+type Issuer struct {
+	Tenant       string
+	config       TenantConfig
+	openIdConfig *OpenIdConfig
+	jwks         *JwksCache
+	logger       *zap.Logger
+}
+
+func NewIssuer(config TenantConfig, logger *zap.Logger) *Issuer {
+	return &Issuer{
+		Tenant: config.Id,
+		config: config,
+		logger: logger.With(zap.String("tenant", config.Id)),
+	}
+}
+
+// LoadOpenIdConfig discovers the issuer and its JWKS, the keys are
+// loaded with the JWKS cache
+func (i *Issuer) LoadOpenIdConfig(ctx context.Context, client *http.Client, global *Config) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", i.config.OpenIdConfigurationUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer ignore(resp.Body.Close)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("discovery endpoint answered %s", resp.Status)
+	}
+	var config OpenIdConfig
+	if err = json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return err
+	}
+	if err = config.Check(&i.config); err != nil {
+		return err
+	}
+	i.openIdConfig = &config
+	jwksUrl := config.JwksUrl(&i.config)
+	if config.JwksUri != "" && jwksUrl != config.JwksUri {
+		i.logger.Warn("JWKS_URL overrides the jwks_uri of the issuer",
+			zap.String("jwksUri", config.JwksUri),
+			zap.String("jwksUrl", jwksUrl))
+	}
+	i.jwks = NewJwksCache(jwksUrl,
+		client,
+		global.JwksMinRefreshInterval,
+		global.JwksRefreshInterval,
+		i.logger)
+	i.logger.Info("OpenId configuration loaded", zap.String("issuer", config.Issuer))
+	return nil
+}
+
+// checkClaims keeps out the tokens of other clients and ID tokens
+// which are signed by the same user pool
+func (i *Issuer) checkClaims(token *jwt.Token) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return invalidToken("invalid claims")
+	}
+	if len(i.config.TokenUse) > 0 {
+		tokenUse, _ := claims[CognitoTokenUseClaim].(string)
+		if !slices.Contains(i.config.TokenUse, tokenUse) {
+			return invalidToken("token_use %q is not allowed", tokenUse)
+		}
+	}
+	if len(i.config.ClientIds) > 0 {
+		// Access tokens name the client in client_id, ID tokens in aud
+		clientId, _ := claims[CognitoClientIdClaim].(string)
+		audience, _ := claims.GetAudience()
+		if !slices.Contains(i.config.ClientIds, clientId) &&
+			!slices.ContainsFunc(audience, func(aud string) bool { return slices.Contains(i.config.ClientIds, aud) }) {
+			if clientId == "" && len(audience) > 0 {
+				clientId = audience[0]
+			}
+			return invalidToken("client %q is not allowed", clientId)
+		}
+	}
+	if len(i.config.RequiredScopes) > 0 {
+		scope, _ := claims[ScopeClaim].(string)
+		scopes := strings.Fields(scope)
+		for _, required := range i.config.RequiredScopes {
+			if !slices.Contains(scopes, required) {
+				return &TokenError{
+					Code:        TokenErrorInsufficientScope,
+					Description: fmt.Sprintf("missing scope %q", required),
+					Scope:       strings.Join(i.config.RequiredScopes, " "),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type IssuerDiagnostics struct {
+	Tenant string           `json:"tenant"`
+	Issuer string           `json:"issuer"`
+	Jwks   *JwksDiagnostics `json:"jwks"`
+}
+
+func (i *Issuer) Diagnostics() *IssuerDiagnostics {
+	return &IssuerDiagnostics{
+		Tenant: i.Tenant,
+		Issuer: i.openIdConfig.Issuer,
+		Jwks:   i.jwks.Diagnostics(),
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// JournalCompactEntries is how many changes a journal collects
+// before they are folded into the snapshot
+const JournalCompactEntries = 1000
+
+// Journal persists a store as a JSON snapshot at the path and the changes made
+// since then as JSON lines in <path>.log, so a change only appends its own line.
+// Applying a change twice must leave the store the same, the changes folded into
+// a snapshot are replayed again when the log could not be truncated afterwards.
+type Journal struct {
+	path    string
+	log     *os.File
+	offset  int64
+	entries int
+}
+
+// OpenJournal reads the snapshot into value and passes every change logged after it
+// to apply. A torn line at the end of the log, left by a crash, is dropped.
+func OpenJournal(path string, value any, apply func(data []byte) error) (*Journal, error) {
+	if err := ReadJSONFile(path, value); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(path+".log", os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	journal := &Journal{path: path, log: log}
+	if err = journal.replay(apply); err != nil {
+		ignore(log.Close)
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (j *Journal) replay(apply func(data []byte) error) error {
+	reader := bufio.NewReader(j.log)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !json.Valid(line) {
+			break
+		}
+		if err = apply(line); err != nil {
+			return err
+		}
+		j.offset += int64(len(line))
+		j.entries++
+	}
+	return j.truncate(j.offset)
+}
+
+func (j *Journal) truncate(offset int64) error {
+	if err := j.log.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := j.log.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	j.offset = offset
+	return nil
+}
+
+// Append logs the changes. Once enough of them are logged the snapshot is
+// replaced with the current value and the log starts over. The changes are
+// already logged then, so a failed compaction is only tried again next time.
+func (j *Journal) Append(value any, changes ...any) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, change := range changes {
+		if err := encoder.Encode(change); err != nil {
+			return err
+		}
+	}
+	written, err := j.log.Write(buf.Bytes())
+	if err != nil {
+		// Later changes would be dropped behind a torn line
+		if written > 0 {
+			ignore(func() error { return j.truncate(j.offset) })
+		}
+		return err
+	}
+	j.offset += int64(written)
+	j.entries += len(changes)
+	if j.entries >= JournalCompactEntries {
+		ignore(func() error { return j.compact(value) })
+	}
+	return nil
+}
+
+func (j *Journal) compact(value any) error {
+	if err := WriteJSONFile(j.path, value); err != nil {
+		return err
+	}
+	if err := j.truncate(0); err != nil {
+		return err
+	}
+	j.entries = 0
+	return nil
+}
+
+func (j *Journal) Close() error {
+	return j.log.Close()
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+type localStores struct {
+	rooms    *LocalRoomStore
+	receipts *LocalReceiptStore
+	mentions *LocalMentionStore
+}
+
+func openLocalStores(t *testing.T, dir string) *localStores {
+	t.Helper()
+	rooms, err := NewLocalRoomStore(filepath.Join(dir, "rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipts, err := NewLocalReceiptStore(filepath.Join(dir, "receipts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mentions, err := NewLocalMentionStore(filepath.Join(dir, "mentions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ignore(rooms.journal.Close)
+		ignore(receipts.journal.Close)
+		ignore(mentions.journal.Close)
+	})
+	return &localStores{rooms: rooms, receipts: receipts, mentions: mentions}
+}
+
+func (s *localStores) fill(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	room := &Room{Id: testRoom, Tenant: DefaultTenant, Members: map[string]Role{"alice": RoleOwner}}
+	if err := s.rooms.Create(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.rooms.Update(ctx, testRoom, func(room *Room) error {
+		room.Members["bob"] = RoleMember
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []uint64{3, 7, 5} {
+		if _, err = s.receipts.MarkRead(ctx, testRoom, DefaultTenant, "alice", seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		record := MentionRecord{Room: testRoom, MessageId: id}
+		if err = s.mentions.Add(ctx, DefaultTenant, []string{"alice", "bob"}, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (s *localStores) check(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	room, err := s.rooms.Get(ctx, testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(room.Members) != 2 || room.Members["bob"] != RoleMember {
+		t.Errorf("members %v, want alice and bob", room.Members)
+	}
+	receipts, err := s.receipts.LastRead(ctx, DefaultTenant, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipts[testRoom] != 7 {
+		t.Errorf("last read %d, want 7", receipts[testRoom])
+	}
+	for _, username := range []string{"alice", "bob"} {
+		mentions, err := s.mentions.List(ctx, DefaultTenant, username, HistoryQuery{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(mentions))
+		for i, mention := range mentions {
+			ids[i] = mention.MessageId
+		}
+		if !slices.Equal(ids, []string{"a", "b", "c"}) || mentions[2].Seq != 3 {
+			t.Errorf("mentions of %s %+v, want a, b and c", username, mentions)
+		}
+	}
+}
+
+func TestLocalStoresSurviveReopen(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, log string)
+	}{
+		{
+			name:   "clean",
+			damage: func(*testing.T, string) {},
+		},
+		{
+			name: "torn tail",
+			damage: func(t *testing.T, log string) {
+				file, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer ignore(file.Close)
+				if _, err = file.WriteString(`{"user":"alice","ro`); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// A crash after compacting but before the log was truncated
+			name: "replayed twice",
+			damage: func(t *testing.T, log string) {
+				data, err := os.ReadFile(log)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = os.WriteFile(log, append(data, data...), 0o640); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			openLocalStores(t, dir).fill(t)
+			logs, err := filepath.Glob(filepath.Join(dir, "*.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != 3 {
+				t.Fatalf("logs %v, want one for each store", logs)
+			}
+			for _, log := range logs {
+				test.damage(t, log)
+			}
+
+			stores := openLocalStores(t, dir)
+			stores.check(t)
+			// Changes after a torn tail must not end up behind it
+			if _, err = stores.receipts.MarkRead(context.Background(), testRoom, DefaultTenant, "alice", 9); err != nil {
+				t.Fatal(err)
+			}
+			receipts, err := openLocalStores(t, dir).receipts.LastRead(context.Background(), DefaultTenant, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if receipts[testRoom] != 9 {
+				t.Errorf("last read %d after reopening, want 9", receipts[testRoom])
+			}
+		})
+	}
+}
+
+func TestJournalCompacts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "receipts.json")
+	store, err := NewLocalReceiptStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignore(store.journal.Close)
+	for seq := range uint64(JournalCompactEntries + 10) {
+		if _, err = store.MarkRead(context.Background(), testRoom, DefaultTenant, "alice", seq+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var snapshot map[string]map[string]uint64
+	if err = ReadJSONFile(path, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if read := snapshot[UserKey(DefaultTenant, "alice")][testRoom]; read != JournalCompactEntries {
+		t.Errorf("snapshot has %d read, want %d", read, JournalCompactEntries)
+	}
+	if store.journal.entries != 10 {
+		t.Errorf("%d changes logged after compacting, want 10", store.journal.entries)
+	}
+
+	reopened, err := NewLocalReceiptStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignore(reopened.journal.Close)
+	receipts, err := reopened.LastRead(context.Background(), DefaultTenant, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipts[testRoom] != JournalCompactEntries+10 {
+		t.Errorf("last read %d after reopening, want %d", receipts[testRoom], JournalCompactEntries+10)
+	}
+}
@@ -1,16 +1,25 @@
 package internal
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/big"
+	"slices"
 )
 
 type JWK struct {
 	Kid string `json:"kid"`
 	N   string `json:"n"`
 	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
 	Alg string `json:"alg"`
 	Use string `json:"use"`
 	Kty string `json:"kty"`
@@ -20,26 +29,128 @@ type JWKS struct {
 	Keys []JWK `json:"keys"`
 }
 
-func (j *JWKS) ToRSAMap() (map[string]*rsa.PublicKey, error) {
-	m := make(map[string]*rsa.PublicKey, len(j.Keys))
-	for _, key := range j.Keys {
-		if key.Alg == "RS256" && key.Kty == "RSA" {
-			nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
-			if err != nil {
-				return nil, err
-			}
-			eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
-			if err != nil {
-				return nil, err
-			}
-			nBig := new(big.Int).SetBytes(nBytes)
-			var leftPadEBytes [4]byte
-			copy(leftPadEBytes[4-len(eBytes):], eBytes)
-			m[key.Kid] = &rsa.PublicKey{
-				N: nBig,
-				E: int(binary.BigEndian.Uint32(leftPadEBytes[:])),
-			}
+// Key is a verification key pinned to the algorithms its JWK allows
+type Key struct {
+	Algs   []string
+	Public crypto.PublicKey
+}
+
+// KeySet maps key ids to keys
+type KeySet map[string]*Key
+
+var errUnsupportedKey = errors.New("unsupported key")
+
+// SigningAlgorithms are the JWS algorithms tokens may be signed with
+var SigningAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// rsaAlgs may use RSA keys whose JWK does not name an algorithm, alg is optional in RFC 7517
+var rsaAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+
+// curveAlgs pairs every curve with the only algorithm that may use it
+var curveAlgs = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// ToKeySet parses the RSA and EC signing keys. Keys of other types and
+// encryption keys are left out, the reasons are returned as skipped.
+func (j *JWKS) ToKeySet() (keys KeySet, skipped []error, err error) {
+	keys = make(KeySet, len(j.Keys))
+	for _, jwk := range j.Keys {
+		key, err := jwk.ToKey()
+		if errors.Is(err, errUnsupportedKey) {
+			skipped = append(skipped, fmt.Errorf("key %q: %w", jwk.Kid, err))
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, skipped, nil
+}
+
+func (k *JWK) ToKey() (*Key, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("%w: use %s", errUnsupportedKey, k.Use)
+	}
+	switch k.Kty {
+	case "RSA":
+		return k.toRSAKey()
+	case "EC":
+		return k.toECKey()
+	default:
+		return nil, fmt.Errorf("%w: kty %s", errUnsupportedKey, k.Kty)
+	}
+}
+
+// toRSAKey pins the key to the RSA algorithms when the JWK does not name one
+func (k *JWK) toRSAKey() (*Key, error) {
+	algs := rsaAlgs
+	if k.Alg != "" {
+		if !slices.Contains(rsaAlgs, k.Alg) {
+			return nil, fmt.Errorf("%w: alg %s", errUnsupportedKey, k.Alg)
 		}
+		algs = []string{k.Alg}
+	}
+	nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(eBytes) == 0 || len(eBytes) > 4 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	nBig := new(big.Int).SetBytes(nBytes)
+	var leftPadEBytes [4]byte
+	copy(leftPadEBytes[4-len(eBytes):], eBytes)
+	return &Key{
+		Algs: algs,
+		Public: &rsa.PublicKey{
+			N: nBig,
+			E: int(binary.BigEndian.Uint32(leftPadEBytes[:])),
+		},
+	}, nil
+}
+
+// toECKey infers the algorithm from the curve when the JWK does not name it.
+// Another alg is an ECDH encryption key or one this curve can not sign for.
+func (k *JWK) toECKey() (*Key, error) {
+	curve, ok := curves[k.Crv]
+	if !ok {
+		return nil, fmt.Errorf("%w: crv %s", errUnsupportedKey, k.Crv)
+	}
+	alg := curveAlgs[k.Crv]
+	if k.Alg != "" && k.Alg != alg {
+		return nil, fmt.Errorf("%w: alg %s on curve %s", errUnsupportedKey, k.Alg, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x) != size || len(y) != size {
+		return nil, errors.New("invalid EC coordinates")
+	}
+	// Parsing the uncompressed point checks that it is on the curve
+	point := append(append([]byte{4}, x...), y...)
+	public, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+	if err != nil {
+		return nil, err
 	}
-	return m, nil
+	return &Key{Algs: []string{alg}, Public: public}, nil
 }
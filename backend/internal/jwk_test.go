@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+)
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+func rsaJWK(t *testing.T, kid, alg, use string) JWK {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return JWK{Kid: kid, Kty: "RSA", Alg: alg, Use: use, N: b64(key.N.Bytes()), E: "AQAB"}
+}
+
+func ecJWK(t *testing.T, kid string, curve elliptic.Curve, crv, alg string) JWK {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	return JWK{
+		Kid: kid,
+		Kty: "EC",
+		Crv: crv,
+		Alg: alg,
+		X:   b64(key.X.FillBytes(make([]byte, size))),
+		Y:   b64(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func TestJWKToKey(t *testing.T) {
+	badCoordinates := ecJWK(t, "ec", elliptic.P256(), "P-256", "")
+	badCoordinates.Y = badCoordinates.X
+	tests := []struct {
+		name        string
+		jwk         JWK
+		algs        []string
+		unsupported bool
+		invalid     bool
+	}{
+		{name: "RSA with alg", jwk: rsaJWK(t, "rs", "RS256", "sig"), algs: []string{"RS256"}},
+		{name: "RSA-PSS", jwk: rsaJWK(t, "ps", "PS384", ""), algs: []string{"PS384"}},
+		{name: "RSA without alg", jwk: rsaJWK(t, "rsa", "", ""), algs: rsaAlgs},
+		{name: "RSA encryption key", jwk: rsaJWK(t, "enc", "RSA-OAEP", "enc"), unsupported: true},
+		{name: "RSA with other alg", jwk: rsaJWK(t, "hs", "HS256", ""), unsupported: true},
+		{name: "P-256", jwk: ecJWK(t, "ec", elliptic.P256(), "P-256", ""), algs: []string{"ES256"}},
+		{name: "P-384 with alg", jwk: ecJWK(t, "ec", elliptic.P384(), "P-384", "ES384"), algs: []string{"ES384"}},
+		{name: "P-521", jwk: ecJWK(t, "ec", elliptic.P521(), "P-521", ""), algs: []string{"ES512"}},
+		{name: "curve and alg disagree", jwk: ecJWK(t, "ec", elliptic.P256(), "P-256", "ES384"), unsupported: true},
+		{name: "EC encryption key without use", jwk: ecJWK(t, "ecdh", elliptic.P256(), "P-256", "ECDH-ES"), unsupported: true},
+		{name: "point off the curve", jwk: badCoordinates, invalid: true},
+		{name: "unknown curve", jwk: JWK{Kid: "ec", Kty: "EC", Crv: "P-192"}, unsupported: true},
+		{name: "symmetric key", jwk: JWK{Kid: "oct", Kty: "oct"}, unsupported: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := test.jwk.ToKey()
+			switch {
+			case test.unsupported:
+				if !errors.Is(err, errUnsupportedKey) {
+					t.Errorf("got %v, want an unsupported key", err)
+				}
+			case test.invalid:
+				if err == nil || errors.Is(err, errUnsupportedKey) {
+					t.Errorf("got %v, want an invalid key", err)
+				}
+			case err != nil:
+				t.Errorf("got %v", err)
+			case !slices.Equal(key.Algs, test.algs):
+				t.Errorf("algorithms %v, want %v", key.Algs, test.algs)
+			}
+		})
+	}
+}
+
+func TestJWKSToKeySetSkipsUnsupportedKeys(t *testing.T) {
+	jwks := JWKS{Keys: []JWK{
+		rsaJWK(t, "rs", "RS256", ""),
+		rsaJWK(t, "enc", "RSA-OAEP", "enc"),
+		ecJWK(t, "ecdh", elliptic.P384(), "P-384", "ECDH-ES+A128KW"),
+		{Kid: "oct", Kty: "oct"},
+	}}
+	keys, skipped, err := jwks.ToKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["rs"] == nil {
+		t.Errorf("keys %v, want only rs", keys)
+	}
+	if len(skipped) != 3 {
+		t.Errorf("skipped %v, want enc, ecdh and oct", skipped)
+	}
+
+	jwks.Keys = append(jwks.Keys, JWK{Kid: "broken", Kty: "RSA", Alg: "RS256", N: "!", E: "AQAB"})
+	if _, _, err = jwks.ToKeySet(); err == nil {
+		t.Error("a malformed signing key was accepted")
+	}
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksTimeout    = 10 * time.Second
+	maxJwksBackoff = 5 * time.Minute
+)
+
+type jwksState struct {
+	keys        KeySet
+	etag        string
+	refreshedAt time.Time
+	expiresAt   time.Time
+}
+
+// JwksCache keeps the keys of a JWKS endpoint. The keys are swapped atomically,
+// so token validation never waits for a refresh. How long they are kept follows
+// the Cache-Control of the endpoint, bounded by the min and max intervals.
+type JwksCache struct {
+	url         string
+	client      *http.Client
+	logger      *zap.Logger
+	minInterval time.Duration
+	maxInterval time.Duration
+	state       atomic.Pointer[jwksState]
+	group       singleflight.Group
+	mutex       sync.Mutex
+	failures    int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func NewJwksCache(url string,
+	client *http.Client,
+	minInterval time.Duration,
+	maxInterval time.Duration,
+	logger *zap.Logger) *JwksCache {
+	return &JwksCache{
+		url:         url,
+		client:      client,
+		logger:      logger.With(zap.String("jwksUrl", url)),
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+	}
+}
+
+// Load fetches the keys, an unchanged JWKS only extends the current ones
+func (c *JwksCache) Load(ctx context.Context) error {
+	_, err, _ := c.group.Do(c.url, func() (any, error) {
+		err := c.load(ctx)
+		c.record(err)
+		return nil, err
+	})
+	return err
+}
+
+func (c *JwksCache) load(ctx context.Context) error {
+	current := c.state.Load()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.etag != "" {
+		req.Header.Set("If-None-Match", current.etag)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer ignore(resp.Body.Close)
+	now := time.Now()
+	next := &jwksState{refreshedAt: now, expiresAt: now.Add(c.maxAge(resp.Header))}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && current != nil:
+		next.keys = current.keys
+		next.etag = current.etag
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		var jwks JWKS
+		if err = json.Unmarshal(data, &jwks); err != nil {
+			return err
+		}
+		var skipped []error
+		if next.keys, skipped, err = jwks.ToKeySet(); err != nil {
+			return err
+		}
+		for _, reason := range skipped {
+			c.logger.Warn("skipping JWK", zap.Error(reason))
+		}
+		next.etag = resp.Header.Get("ETag")
+		c.logger.Info("JWKS refreshed", zap.Int("keys", len(next.keys)))
+	default:
+		return fmt.Errorf("JWKS endpoint answered %s", resp.Status)
+	}
+	c.state.Store(next)
+	return nil
+}
+
+func (c *JwksCache) record(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	c.lastError = err.Error()
+	c.lastErrorAt = time.Now()
+}
+
+// maxAge reads how long the response may be cached, Expires is not used
+func (c *JwksCache) maxAge(header http.Header) time.Duration {
+	maxAge := c.maxInterval
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store":
+			return c.minInterval
+		case "max-age":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			maxAge = time.Duration(seconds) * time.Second
+			if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+				maxAge -= time.Duration(age) * time.Second
+			}
+		}
+	}
+	return min(max(maxAge, c.minInterval), c.maxInterval)
+}
+
+// Lookup returns the key with the id. Unknown ids trigger a refresh,
+// at most once per min interval, in case the keys were rotated.
+func (c *JwksCache) Lookup(ctx context.Context, kid string) (*Key, error) {
+	state := c.state.Load()
+	if state != nil {
+		if key, ok := state.keys[kid]; ok {
+			return key, nil
+		}
+		if time.Since(state.refreshedAt) < c.minInterval {
+			return nil, errUnknownKey
+		}
+	}
+	c.logger.Info("jwk not found for token, refreshing", zap.String(JwtKid, kid))
+	ctx, cancel := context.WithTimeout(ctx, jwksTimeout)
+	defer cancel()
+	if err := c.Load(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := c.state.Load().keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// Run refreshes the keys before they expire until the context is done.
+// Failed refreshes are retried with an exponential backoff and the
+// current keys stay in use meanwhile.
+func (c *JwksCache) Run(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		wait := backoff
+		if state := c.state.Load(); wait == 0 && state != nil {
+			wait = time.Until(state.expiresAt)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		loadCtx, cancel := context.WithTimeout(ctx, jwksTimeout)
+		err := c.Load(loadCtx)
+		cancel()
+		if err == nil {
+			backoff = 0
+			continue
+		}
+		backoff = nextJwksBackoff(backoff)
+		c.logger.Warn("failed to refresh JWKS", zap.Duration("retryIn", backoff), zap.Error(err))
+	}
+}
+
+// nextJwksBackoff doubles the wait after every failed refresh, from a second
+// up to maxJwksBackoff
+func nextJwksBackoff(backoff time.Duration) time.Duration {
+	return min(max(2*backoff, time.Second), maxJwksBackoff)
+}
+
+type KeyDiagnostics struct {
+	Kid  string   `json:"kid"`
+	Algs []string `json:"algs"`
+}
+
+type JwksDiagnostics struct {
+	Url         string           `json:"url"`
+	RefreshedAt time.Time        `json:"refreshed_at"`
+	ExpiresAt   time.Time        `json:"expires_at"`
+	ETag        string           `json:"etag,omitempty"`
+	Keys        []KeyDiagnostics `json:"keys"`
+	Failures    int              `json:"failures"`
+	LastError   string           `json:"last_error,omitempty"`
+	LastErrorAt *time.Time       `json:"last_error_at,omitempty"`
+}
+
+func (c *JwksCache) Diagnostics() *JwksDiagnostics {
+	diagnostics := &JwksDiagnostics{Url: c.url, Keys: []KeyDiagnostics{}}
+	if state := c.state.Load(); state != nil {
+		diagnostics.RefreshedAt = state.refreshedAt
+		diagnostics.ExpiresAt = state.expiresAt
+		diagnostics.ETag = state.etag
+		for kid, key := range state.keys {
+			diagnostics.Keys = append(diagnostics.Keys, KeyDiagnostics{Kid: kid, Algs: key.Algs})
+		}
+		slices.SortFunc(diagnostics.Keys, func(a, b KeyDiagnostics) int {
+			return strings.Compare(a.Kid, b.Kid)
+		})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	diagnostics.Failures = c.failures
+	diagnostics.LastError = c.lastError
+	if !c.lastErrorAt.IsZero() {
+		lastErrorAt := c.lastErrorAt
+		diagnostics.LastErrorAt = &lastErrorAt
+	}
+	return diagnostics
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// jwksServer serves a JWKS with an ETag or fails with status when it is set
+type jwksServer struct {
+	*httptest.Server
+	mutex        sync.Mutex
+	jwks         JWKS
+	etag         string
+	cacheControl string
+	status       int
+	requests     []*http.Request
+}
+
+func newJwksServer(t *testing.T, keys ...JWK) *jwksServer {
+	t.Helper()
+	server := &jwksServer{jwks: JWKS{Keys: keys}, etag: `"v1"`}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.requests = append(server.requests, req)
+		if server.status != 0 {
+			w.WriteHeader(server.status)
+			return
+		}
+		w.Header().Set("ETag", server.etag)
+		w.Header().Set("Cache-Control", server.cacheControl)
+		if req.Header.Get("If-None-Match") == server.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(server.jwks)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *jwksServer) update(fn func(s *jwksServer)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn(s)
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests)
+}
+
+func TestJwksCacheRevalidatesWithETag(t *testing.T) {
+	server := newJwksServer(t, ecJWK(t, "ec", elliptic.P256(), "P-256", "ES256"))
+	server.cacheControl = "max-age=600"
+	cache := NewJwksCache(server.URL, server.Client(), time.Minute, time.Hour, zap.NewNop())
+	ctx := context.Background()
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := cache.state.Load()
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var ifNoneMatch string
+	server.update(func(s *jwksServer) { ifNoneMatch = s.requests[1].Header.Get("If-None-Match") })
+	if got := ifNoneMatch; got != `"v1"` {
+		t.Errorf("revalidated with If-None-Match %q, want the ETag", got)
+	}
+	second := cache.state.Load()
+	if _, ok := second.keys["ec"]; !ok || second.etag != `"v1"` {
+		t.Errorf("an unchanged JWKS left keys %v and ETag %q", second.keys, second.etag)
+	}
+	if !second.expiresAt.After(first.expiresAt) {
+		t.Error("an unchanged JWKS did not extend the keys")
+	}
+
+	server.update(func(s *jwksServer) {
+		s.jwks = JWKS{Keys: []JWK{ecJWK(t, "rotated", elliptic.P256(), "P-256", "ES256")}}
+		s.etag = `"v2"`
+	})
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Lookup(ctx, "rotated"); err != nil {
+		t.Errorf("rotated key not found: %v", err)
+	}
+}
+
+func TestJwksCacheMaxAge(t *testing.T) {
+	cache := NewJwksCache("", http.DefaultClient, time.Minute, time.Hour, zap.NewNop())
+	tests := []struct {
+		name         string
+		cacheControl string
+		age          string
+		want         time.Duration
+	}{
+		{name: "no header", want: time.Hour},
+		{name: "within bounds", cacheControl: "public, max-age=600", want: 10 * time.Minute},
+		{name: "minus age", cacheControl: "max-age=600", age: "100", want: 500 * time.Second},
+		{name: "below min interval", cacheControl: "max-age=30", want: time.Minute},
+		{name: "older than max-age", cacheControl: "max-age=600", age: "900", want: time.Minute},
+		{name: "above max interval", cacheControl: "max-age=86400", want: time.Hour},
+		{name: "no-cache", cacheControl: "no-cache, max-age=600", want: time.Minute},
+		{name: "malformed max-age", cacheControl: "max-age=soon", want: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Cache-Control", test.cacheControl)
+			header.Set("Age", test.age)
+			if got := cache.maxAge(header); got != test.want {
+				t.Errorf("max age %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJwksCacheKeepsKeysAfterErrors(t *testing.T) {
+	server := newJwksServer(t, ecJWK(t, "ec", elliptic.P256(), "P-256", "ES256"))
+	cache := NewJwksCache(server.URL, server.Client(), time.Hour, time.Hour, zap.NewNop())
+	ctx := context.Background()
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	server.update(func(s *jwksServer) { s.status = http.StatusInternalServerError })
+	for range 2 {
+		if err := cache.Load(ctx); err == nil {
+			t.Fatal("a failed refresh reported no error")
+		}
+	}
+	diagnostics := cache.Diagnostics()
+	if diagnostics.Failures != 2 || diagnostics.LastError == "" || diagnostics.LastErrorAt == nil {
+		t.Errorf("diagnostics %+v, want 2 failures and the last error", diagnostics)
+	}
+	if _, err := cache.Lookup(ctx, "ec"); err != nil {
+		t.Errorf("key dropped after a failed refresh: %v", err)
+	}
+	// Unknown keys do not hammer a failing endpoint within the min interval
+	requests := server.requestCount()
+	if _, err := cache.Lookup(ctx, "unknown"); !errors.Is(err, errUnknownKey) {
+		t.Errorf("lookup of an unknown key got %v", err)
+	}
+	if server.requestCount() != requests {
+		t.Error("an unknown key was fetched within the min interval")
+	}
+
+	server.update(func(s *jwksServer) { s.status = 0 })
+	if err := cache.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if failures := cache.Diagnostics().Failures; failures != 0 {
+		t.Errorf("%d failures after a successful refresh, want 0", failures)
+	}
+}
+
+func TestNextJwksBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{backoff: 0, want: time.Second},
+		{backoff: time.Second, want: 2 * time.Second},
+		{backoff: 2 * time.Minute, want: 4 * time.Minute},
+		{backoff: 4 * time.Minute, want: maxJwksBackoff},
+		{backoff: maxJwksBackoff, want: maxJwksBackoff},
+	}
+	for _, test := range tests {
+		if got := nextJwksBackoff(test.backoff); got != test.want {
+			t.Errorf("backoff after %v is %v, want %v", test.backoff, got, test.want)
+		}
+	}
+}
+
+func TestJwksCacheRunRetriesFailedRefreshes(t *testing.T) {
+	server := newJwksServer(t, ecJWK(t, "ec", elliptic.P256(), "P-256", "ES256"))
+	server.status = http.StatusServiceUnavailable
+	cache := NewJwksCache(server.URL, server.Client(), time.Second, time.Hour, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.Run(ctx)
+	// The first refresh runs at once and fails, the retry comes a second later
+	time.Sleep(100 * time.Millisecond)
+	if server.requestCount() != 1 {
+		t.Fatalf("%d requests before the backoff ran out, want 1", server.requestCount())
+	}
+	server.update(func(s *jwksServer) { s.status = 0 })
+	deadline := time.Now().Add(3 * time.Second)
+	for cache.state.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("keys not loaded after the backoff")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if requests := server.requestCount(); requests != 2 {
+		t.Errorf("%d requests, want the failed one and its retry", requests)
+	}
+}
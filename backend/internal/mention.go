@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	MentionUser = "user"
+	MentionRoom = "room"
+	// MaxStoredMentions is how many of the latest mentions are kept per user
+	MaxStoredMentions = 1000
+)
+
+// A mention starts a word, so email addresses do not mention anyone
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.+-])@([\w.+-]+)`)
+
+type Mention struct {
+	Kind string `json:"kind"`
+	// Username is empty when the whole room is mentioned
+	Username string `json:"username,omitempty"`
+}
+
+// ParseMentions resolves @username and @room tokens against the members of the room
+func ParseMentions(body string, room *Room) []Mention {
+	var mentions []Mention
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		name := strings.TrimRight(match[1], ".-")
+		var mention Mention
+		if name == MentionRoom {
+			mention = Mention{Kind: MentionRoom}
+		} else if _, ok := room.Members[name]; ok {
+			mention = Mention{Kind: MentionUser, Username: name}
+		} else {
+			continue
+		}
+		if !slices.Contains(mentions, mention) {
+			mentions = append(mentions, mention)
+		}
+	}
+	return mentions
+}
+
+// MentionedUsers lists the members reached by the mentions, never the sender
+func MentionedUsers(mentions []Mention, room *Room, sender string) []string {
+	var usernames []string
+	for _, mention := range mentions {
+		if mention.Kind == MentionRoom {
+			usernames = slices.Collect(maps.Keys(room.Members))
+			break
+		}
+		usernames = append(usernames, mention.Username)
+	}
+	slices.Sort(usernames)
+	return slices.DeleteFunc(slices.Compact(usernames), func(username string) bool {
+		return username == sender
+	})
+}
+
+type MentionRecord struct {
+	// Seq orders the mentions of one user
+	Seq       uint64    `json:"seq"`
+	Room      string    `json:"room"`
+	MessageId string    `json:"message_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MentionStore keeps the latest mentions of every user so they can catch up later
+type MentionStore interface {
+	Add(ctx context.Context, tenant string, usernames []string, record MentionRecord) error
+	// List pages through the mentions of a user, newest last like room history
+	List(ctx context.Context, tenant, username string, query HistoryQuery) ([]MentionRecord, error)
+}
+
+func NewMentionStore(config *Config) (MentionStore, error) {
+	switch config.MessageStore {
+	case MessageStoreDisk:
+		return NewLocalMentionStore(filepath.Join(config.MessageStoreDir, "mentions.json"))
+	case MessageStoreRedis:
+		return NewRedisMentionStore(config.RedisUrl)
+	default:
+		return NewLocalMentionStore("")
+	}
+}
+
+type userMentions struct {
+	Last    uint64          `json:"last"`
+	Records []MentionRecord `json:"records"`
+}
+
+// LocalMentionStore keeps mentions in memory by UserKey, with a non-empty
+// path they are also kept in a Journal there
+type LocalMentionStore struct {
+	mutex   sync.RWMutex
+	journal *Journal
+	users   map[string]*userMentions
+}
+
+type mentionChange struct {
+	User   string        `json:"user"`
+	Record MentionRecord `json:"record"`
+}
+
+func NewLocalMentionStore(path string) (*LocalMentionStore, error) {
+	store := &LocalMentionStore{
+		users: make(map[string]*userMentions),
+	}
+	if path == "" {
+		return store, nil
+	}
+	journal, err := OpenJournal(path, &store.users, func(data []byte) error {
+		var change mentionChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			return err
+		}
+		mentions := store.mentions(change.User)
+		// Already in the snapshot
+		if change.Record.Seq <= mentions.Last {
+			return nil
+		}
+		mentions.add(change.Record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+	return store, nil
+}
+
+func (s *LocalMentionStore) mentions(key string) *userMentions {
+	mentions, ok := s.users[key]
+	if !ok {
+		mentions = &userMentions{}
+		s.users[key] = mentions
+	}
+	return mentions
+}
+
+func (m *userMentions) add(record MentionRecord) {
+	m.Last = record.Seq
+	m.Records = append(m.Records, record)
+	if len(m.Records) > MaxStoredMentions {
+		m.Records = slices.Delete(m.Records, 0, len(m.Records)-MaxStoredMentions)
+	}
+}
+
+func (s *LocalMentionStore) Add(_ context.Context, tenant string, usernames []string, record MentionRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := make([]any, 0, len(usernames))
+	for _, username := range usernames {
+		key := UserKey(tenant, username)
+		mentions := s.mentions(key)
+		record.Seq = mentions.Last + 1
+		mentions.add(record)
+		changes = append(changes, mentionChange{User: key, Record: record})
+	}
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.Append(s.users, changes...)
+}
+
+func (s *LocalMentionStore) List(
+	_ context.Context,
+	tenant, username string,
+	query HistoryQuery,
+) ([]MentionRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	mentions, ok := s.users[UserKey(tenant, username)]
+	if !ok {
+		return nil, nil
+	}
+	end := len(mentions.Records)
+	if query.Before != 0 {
+		end, _ = slices.BinarySearchFunc(mentions.Records, query.Before, func(r MentionRecord, seq uint64) int {
+			return cmp.Compare(r.Seq, seq)
+		})
+	}
+	start := max(end-query.Limit, 0)
+	return slices.Clone(mentions.Records[start:end]), nil
+}
+
+type MentionsRouter struct {
+	logger   *zap.Logger
+	router   *mux.Router
+	mentions MentionStore
+	store    MessageStore
+	rooms    RoomStore
+}
+
+func NewMentionsRouter(logger *zap.Logger,
+	rootRouter *mux.Router,
+	validator *TokenValidator,
+	mentions MentionStore,
+	store MessageStore,
+	rooms RoomStore) *MentionsRouter {
+	router := rootRouter.PathPrefix("/me").Subrouter()
+	router.Use(validator.ValidatingMiddleware)
+	mentionsRouter := &MentionsRouter{logger: logger,
+		router:   router,
+		mentions: mentions,
+		store:    store,
+		rooms:    rooms}
+	mentionsRouter.registerRoutes()
+	return mentionsRouter
+}
+
+func (r *MentionsRouter) registerRoutes() {
+	r.router.HandleFunc("/mentions", r.GetMentions).Methods("GET")
+}
+
+// GetMentions returns the mentioning messages, leaving out deleted ones
+// and those from rooms the user is no longer a member of
+func (r *MentionsRouter) GetMentions(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	query, err := parseHistoryQuery(req)
+	if err != nil {
+		WriteString(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	tenant := GetTenant(req)
+	records, err := r.mentions.List(req.Context(), tenant, username, query)
+	if err != nil {
+		r.logger.Error("failed to load mentions", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rooms := make(map[string]*Room)
+	response := &HistoryResponse{Messages: make([]*Message, 0, len(records))}
+	for _, record := range records {
+		room, ok := rooms[record.Room]
+		if !ok {
+			room, err = r.rooms.Get(req.Context(), record.Room)
+			if err != nil && !errors.Is(err, ErrRoomNotFound) {
+				r.logger.Error("failed to load room", zap.String("room", record.Room), zap.Error(err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			rooms[record.Room] = room
+		}
+		if room == nil || room.Tenant != tenant || !room.Can(username, PermissionRead) {
+			continue
+		}
+		message, err := r.store.Get(req.Context(), record.Room, record.MessageId)
+		if errors.Is(err, ErrMessageNotFound) {
+			continue
+		}
+		if err != nil {
+			r.logger.Error("failed to load message", zap.String("room", record.Room), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !message.Deleted {
+			response.Messages = append(response.Messages, message)
+		}
+	}
+	if len(records) > 0 && records[0].Seq > 1 {
+		response.Next = EncodeCursor(records[0].Seq)
+	}
+	WriteJSON(w, response, http.StatusOK)
+}
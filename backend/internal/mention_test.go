@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	room := &Room{Id: testRoom, Members: map[string]Role{
+		"alice":      RoleOwner,
+		"bob":        RoleMember,
+		"j.doe":      RoleMember,
+		"anne-marie": RoleMember,
+	}}
+	tests := []struct {
+		name string
+		body string
+		want []Mention
+	}{
+		{name: "member", body: "hi @bob", want: []Mention{{Kind: MentionUser, Username: "bob"}}},
+		{name: "start of the body", body: "@alice look", want: []Mention{{Kind: MentionUser, Username: "alice"}}},
+		{name: "room", body: "@room standup", want: []Mention{{Kind: MentionRoom}}},
+		{
+			name: "punctuation after the name",
+			body: "thanks @bob. and @anne-marie!",
+			want: []Mention{{Kind: MentionUser, Username: "bob"}, {Kind: MentionUser, Username: "anne-marie"}},
+		},
+		{name: "dot in the name", body: "(@j.doe)", want: []Mention{{Kind: MentionUser, Username: "j.doe"}}},
+		{name: "repeated", body: "@bob @bob @bob", want: []Mention{{Kind: MentionUser, Username: "bob"}}},
+		{name: "not a member", body: "@carol are you there", want: nil},
+		{name: "email address", body: "mail bob@example.com", want: nil},
+		{name: "double at", body: "@@bob", want: nil},
+		{name: "no mentions", body: "hello", want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if mentions := ParseMentions(test.body, room); !slices.Equal(mentions, test.want) {
+				t.Errorf("got %+v, want %+v", mentions, test.want)
+			}
+		})
+	}
+}
+
+func TestMentionedUsers(t *testing.T) {
+	room := &Room{Id: testRoom, Members: map[string]Role{"alice": RoleOwner, "bob": RoleMember, "carol": RoleMember}}
+	tests := []struct {
+		name     string
+		mentions []Mention
+		want     []string
+	}{
+		{name: "users", mentions: []Mention{{Kind: MentionUser, Username: "carol"}, {Kind: MentionUser, Username: "bob"}}, want: []string{"bob", "carol"}},
+		{name: "room", mentions: []Mention{{Kind: MentionUser, Username: "bob"}, {Kind: MentionRoom}}, want: []string{"bob", "carol"}},
+		{name: "only the sender", mentions: []Mention{{Kind: MentionUser, Username: "alice"}}, want: []string{}},
+		{name: "none", want: nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			users := MentionedUsers(test.mentions, room, "alice")
+			if !slices.Equal(users, test.want) {
+				t.Errorf("got %v, want %v", users, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Revision is a body the message had before it was edited
+type Revision struct {
+	Body      string    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Message struct {
+	Id        string    `json:"id"`
+	Room      string    `json:"room"`
+	Seq       uint64    `json:"seq"`
+	Sender    string    `json:"sender"`
+	Body      string    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+	// ParentId makes the message a reply in the thread of another message
+	ParentId    string    `json:"parent_id,omitempty"`
+	ReplyCount  int       `json:"reply_count,omitempty"`
+	LastReplyAt time.Time `json:"last_reply_at,omitzero"`
+	Mentions    []Mention `json:"mentions,omitempty"`
+	// Revisions holds the previous bodies, oldest first
+	Revisions []Revision `json:"revisions,omitempty"`
+	EditedAt  time.Time  `json:"edited_at,omitzero"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+	// A deleted message stays in the room as a tombstone without a body
+	Deleted   bool      `json:"deleted,omitempty"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	DeletedAt time.Time `json:"deleted_at,omitzero"`
+}
+
+func (m *Message) clone() *Message {
+	copied := *m
+	copied.Revisions = slices.Clone(m.Revisions)
+	copied.Reactions = cloneReactions(m.Reactions)
+	copied.Mentions = slices.Clone(m.Mentions)
+	return &copied
+}
+
+func (m *Message) Edit(body string, now time.Time) {
+	timestamp := m.Timestamp
+	if !m.EditedAt.IsZero() {
+		timestamp = m.EditedAt
+	}
+	m.Revisions = append(m.Revisions, Revision{Body: m.Body, Timestamp: timestamp})
+	m.Body = body
+	m.EditedAt = now
+}
+
+// Delete turns the message into a tombstone, the edit history and reactions go with the body
+func (m *Message) Delete(username string, now time.Time) {
+	m.Body = ""
+	m.Revisions = nil
+	m.Reactions = nil
+	m.Mentions = nil
+	m.Deleted = true
+	m.DeletedBy = username
+	m.DeletedAt = now
+}
+
+func (m *Message) Frame() *Frame {
+	return &Frame{
+		Type:      FrameMessage,
+		Id:        m.Id,
+		Room:      m.Room,
+		Seq:       m.Seq,
+		Body:      m.Body,
+		Sender:    m.Sender,
+		ParentId:  m.ParentId,
+		Mentions:  m.Mentions,
+		Reactions: m.Reactions,
+		Timestamp: m.Timestamp,
+	}
+}
+
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrMessageDeleted = errors.New("message deleted")
+	ErrEmptyMessage   = errors.New("message body is empty")
+	ErrMessageTooLong = errors.New("message body is too long")
+)
+
+// MaxMessageLength caps the body of a message in characters
+const MaxMessageLength = 4000
+
+// ValidateBody checks the body of a new or edited message
+func ValidateBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(body) > MaxMessageLength {
+		return ErrMessageTooLong
+	}
+	return nil
+}
+
+// Cursors are opaque to clients so the pagination scheme can change
+// without breaking them.
+func EncodeCursor(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(seq, 10)))
+}
+
+func DecodeCursor(cursor string) (uint64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	seq, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
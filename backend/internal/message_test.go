@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{name: "text", body: "hello"},
+		{name: "empty", body: "", want: ErrEmptyMessage},
+		{name: "whitespace", body: " \n\t", want: ErrEmptyMessage},
+		{name: "longest", body: strings.Repeat("ü", MaxMessageLength)},
+		{name: "too long", body: strings.Repeat("a", MaxMessageLength+1), want: ErrMessageTooLong},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ValidateBody(test.body); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"expvar"
+)
+
+// Chat metrics are published with expvar and served on /metrics
+var (
+	metricConnections       = expvar.NewInt("chat_connections")
+	metricConnectionsClosed = expvar.NewInt("chat_connections_closed")
+	metricSlowConsumers     = expvar.NewInt("chat_slow_consumers_closed")
+	metricWriteTimeouts     = expvar.NewInt("chat_write_timeouts")
+	metricFramesDropped     = expvar.NewInt("chat_frames_dropped")
+	metricFramesThrottled   = expvar.NewInt("chat_frames_rate_limited")
+	metricResumesCut        = expvar.NewInt("chat_resumes_cut")
+)
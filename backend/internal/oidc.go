@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const WellKnownOpenIdConfiguration = "/.well-known/openid-configuration"
+
+// OpenIdConfig is the OpenID Connect discovery document of the issuer
+type OpenIdConfig struct {
+	Issuer                           string   `json:"issuer"`
+	JwksUri                          string   `json:"jwks_uri"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+	ScopesSupported                  []string `json:"scopes_supported"`
+	IdTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Check fails when the document is incomplete or disagrees with the config.
+// The issuer has to be the one the document was discovered from and some of
+// its signing algorithms have to be supported. Required scopes are not checked
+// against scopes_supported, Cognito leaves custom scopes out of it.
+func (o *OpenIdConfig) Check(config *TenantConfig) error {
+	if o.Issuer == "" {
+		return errors.New("discovery document has no issuer")
+	}
+	if o.JwksUri == "" && config.JwksUrl == "" {
+		return errors.New("discovery document has no jwks_uri and JWKS_URL is not set")
+	}
+	issuer := strings.TrimSuffix(o.Issuer, "/")
+	if issuer+WellKnownOpenIdConfiguration != config.OpenIdConfigurationUrl {
+		return fmt.Errorf("issuer %s does not serve the discovery document %s",
+			o.Issuer,
+			config.OpenIdConfigurationUrl)
+	}
+	if len(o.IdTokenSigningAlgValuesSupported) > 0 &&
+		!slices.ContainsFunc(o.IdTokenSigningAlgValuesSupported, func(alg string) bool {
+			return slices.Contains(SigningAlgorithms, alg)
+		}) {
+		return fmt.Errorf("none of the signing algorithms %v of the issuer is supported",
+			o.IdTokenSigningAlgValuesSupported)
+	}
+	return nil
+}
+
+// JwksUrl returns the JWKS_URL override or the jwks_uri of the document
+func (o *OpenIdConfig) JwksUrl(config *TenantConfig) string {
+	if config.JwksUrl != "" {
+		return config.JwksUrl
+	}
+	return o.JwksUri
+}
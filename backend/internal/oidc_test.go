@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestOpenIdConfigCheck(t *testing.T) {
+	discoveryUrl := testIssuer + WellKnownOpenIdConfiguration
+	tests := []struct {
+		name    string
+		config  OpenIdConfig
+		jwksUrl string
+		valid   bool
+	}{
+		{name: "valid", config: OpenIdConfig{Issuer: testIssuer, JwksUri: testIssuer + "/jwks"}, valid: true},
+		{name: "issuer with trailing slash", config: OpenIdConfig{Issuer: testIssuer + "/", JwksUri: testIssuer + "/jwks"}, valid: true},
+		{name: "no issuer", config: OpenIdConfig{JwksUri: testIssuer + "/jwks"}},
+		{name: "no jwks_uri", config: OpenIdConfig{Issuer: testIssuer}},
+		{name: "no jwks_uri with an override", config: OpenIdConfig{Issuer: testIssuer}, jwksUrl: "https://keys.example.com", valid: true},
+		{name: "issuer of another URL", config: OpenIdConfig{Issuer: "https://evil.example.com/pool", JwksUri: testIssuer + "/jwks"}},
+		{
+			name: "supported signing algorithm",
+			config: OpenIdConfig{
+				Issuer:                           testIssuer,
+				JwksUri:                          testIssuer + "/jwks",
+				IdTokenSigningAlgValuesSupported: []string{"HS256", "RS256"},
+			},
+			valid: true,
+		},
+		{
+			name: "unsupported signing algorithms",
+			config: OpenIdConfig{
+				Issuer:                           testIssuer,
+				JwksUri:                          testIssuer + "/jwks",
+				IdTokenSigningAlgValuesSupported: []string{"HS256", "none"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Check(&TenantConfig{OpenIdConfigurationUrl: discoveryUrl, JwksUrl: test.jwksUrl})
+			if (err == nil) != test.valid {
+				t.Errorf("check got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestIssuerLoadOpenIdConfig(t *testing.T) {
+	var server *httptest.Server
+	// Documents name the issuer they are discovered from, except under /mismatch
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		issuer := server.URL + strings.TrimSuffix(req.URL.Path, WellKnownOpenIdConfiguration)
+		if strings.HasPrefix(req.URL.Path, "/mismatch") {
+			issuer = server.URL + "/other"
+		}
+		WriteJSON(w, &OpenIdConfig{Issuer: issuer, JwksUri: issuer + "/jwks"}, http.StatusOK)
+	}))
+	defer server.Close()
+	tests := []struct {
+		name     string
+		path     string
+		jwksUrl  string
+		wantJwks string
+		warned   bool
+		valid    bool
+	}{
+		{name: "discovered", path: "/pool", wantJwks: server.URL + "/pool/jwks", valid: true},
+		{name: "overridden", path: "/pool", jwksUrl: "https://keys.example.com", wantJwks: "https://keys.example.com", warned: true, valid: true},
+		{name: "same override", path: "/pool", jwksUrl: server.URL + "/pool/jwks", wantJwks: server.URL + "/pool/jwks", valid: true},
+		{name: "issuer mismatch", path: "/mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			issuer := NewIssuer(TenantConfig{
+				Id:                     DefaultTenant,
+				OpenIdConfigurationUrl: server.URL + test.path + WellKnownOpenIdConfiguration,
+				JwksUrl:                test.jwksUrl,
+			}, zap.New(core))
+			err := issuer.LoadOpenIdConfig(context.Background(), server.Client(), &Config{})
+			if (err == nil) != test.valid {
+				t.Fatalf("load got %v, want valid %v", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if issuer.jwks.url != test.wantJwks {
+				t.Errorf("keys loaded from %s, want %s", issuer.jwks.url, test.wantJwks)
+			}
+			warnings := logs.FilterMessage("JWKS_URL overrides the jwks_uri of the issuer").Len()
+			if (warnings > 0) != test.warned {
+				t.Errorf("%d override warnings, want any %v", warnings, test.warned)
+			}
+		})
+	}
+}
+
+func TestIssuerLoadOpenIdConfigRejectsBadDocuments(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		payload string
+	}{
+		{name: "error status", status: http.StatusNotFound, payload: `{}`},
+		{name: "malformed", status: http.StatusOK, payload: `{"issuer":`},
+		{name: "incomplete", status: http.StatusOK, payload: `{"jwks_uri":"https://keys.example.com"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.payload))
+			}))
+			defer server.Close()
+			issuer := NewIssuer(TenantConfig{OpenIdConfigurationUrl: server.URL + WellKnownOpenIdConfiguration}, zap.NewNop())
+			if err := issuer.LoadOpenIdConfig(context.Background(), server.Client(), &Config{}); err == nil {
+				t.Error("the document was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceAway    PresenceStatus = "away"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+type Presence struct {
+	Tenant   string         `json:"tenant"`
+	Username string         `json:"username"`
+	Status   PresenceStatus `json:"status"`
+	LastSeen time.Time      `json:"last_seen,omitzero"`
+}
+
+type userPresence struct {
+	tenant       string
+	username     string
+	connections  map[*Client]PresenceStatus
+	status       PresenceStatus
+	lastSeen     time.Time
+	offlineTimer *time.Timer
+}
+
+// aggregate is online when any connection is, away when every remaining
+// connection is away. With no connections the published status is kept
+// until the offline grace period ends.
+func (p *userPresence) aggregate() PresenceStatus {
+	if len(p.connections) == 0 {
+		return p.status
+	}
+	for _, status := range p.connections {
+		if status == PresenceOnline {
+			return PresenceOnline
+		}
+	}
+	return PresenceAway
+}
+
+type instanceReport struct {
+	status    PresenceStatus
+	updatedAt time.Time
+}
+
+// clusterPresence combines what every instance reports about a user
+// the same way connections are combined on one instance
+type clusterPresence struct {
+	tenant    string
+	username  string
+	instances map[string]instanceReport
+	status    PresenceStatus
+	lastSeen  time.Time
+}
+
+func (p *clusterPresence) resolve() bool {
+	status := PresenceOffline
+	for _, report := range p.instances {
+		if report.status == PresenceOnline {
+			status = PresenceOnline
+			break
+		}
+		status = PresenceAway
+	}
+	changed := status != p.status
+	p.status = status
+	return changed
+}
+
+func (p *clusterPresence) presence() Presence {
+	return Presence{Tenant: p.tenant, Username: p.username, Status: p.status, LastSeen: p.lastSeen}
+}
+
+// PresenceTracker counts live connections per user, users are told apart by UserKey. Going offline is delayed
+// by the grace period so a quick reconnect does not flap. OnChange reports
+// the presence on this instance, Merge combines the reports of all instances.
+type PresenceTracker struct {
+	mutex    sync.Mutex
+	grace    time.Duration
+	users    map[string]*userPresence
+	cluster  map[string]*clusterPresence
+	onChange func(presence Presence)
+}
+
+func NewPresenceTracker(grace time.Duration) *PresenceTracker {
+	return &PresenceTracker{
+		grace:    grace,
+		users:    make(map[string]*userPresence),
+		cluster:  make(map[string]*clusterPresence),
+		onChange: func(Presence) {},
+	}
+}
+
+func (t *PresenceTracker) OnChange(fn func(presence Presence)) {
+	t.onChange = fn
+}
+
+func (t *PresenceTracker) Connect(c *Client) {
+	t.update(c.tenant, c.username, func(p *userPresence) {
+		if p.offlineTimer != nil {
+			p.offlineTimer.Stop()
+			p.offlineTimer = nil
+		}
+		p.connections[c] = PresenceOnline
+	})
+}
+
+func (t *PresenceTracker) SetStatus(c *Client, status PresenceStatus) {
+	t.update(c.tenant, c.username, func(p *userPresence) {
+		if _, ok := p.connections[c]; ok {
+			p.connections[c] = status
+		}
+	})
+}
+
+func (t *PresenceTracker) Disconnect(c *Client) {
+	t.update(c.tenant, c.username, func(p *userPresence) {
+		delete(p.connections, c)
+		if len(p.connections) == 0 && p.offlineTimer == nil {
+			p.offlineTimer = time.AfterFunc(t.grace, func() {
+				t.expire(c.tenant, c.username)
+			})
+		}
+	})
+}
+
+func (t *PresenceTracker) expire(tenant, username string) {
+	t.update(tenant, username, func(p *userPresence) {
+		p.offlineTimer = nil
+		if len(p.connections) == 0 {
+			p.status = PresenceOffline
+		}
+	})
+}
+
+func (t *PresenceTracker) update(tenant, username string, fn func(p *userPresence)) {
+	t.mutex.Lock()
+	key := UserKey(tenant, username)
+	p, ok := t.users[key]
+	if !ok {
+		p = &userPresence{
+			tenant:      tenant,
+			username:    username,
+			connections: make(map[*Client]PresenceStatus),
+			status:      PresenceOffline,
+		}
+		t.users[key] = p
+	}
+	previous := p.status
+	fn(p)
+	status := p.aggregate()
+	changed := status != previous
+	p.status = status
+	if changed || len(p.connections) > 0 {
+		p.lastSeen = time.Now().UTC()
+	}
+	presence := Presence{Tenant: tenant, Username: username, Status: status, LastSeen: p.lastSeen}
+	t.mutex.Unlock()
+	if changed {
+		t.onChange(presence)
+	}
+}
+
+// Local lists the users with a presence on this instance
+func (t *PresenceTracker) Local() []Presence {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var result []Presence
+	for _, p := range t.users {
+		if p.status != PresenceOffline {
+			result = append(result, Presence{Tenant: p.tenant, Username: p.username, Status: p.status, LastSeen: p.lastSeen})
+		}
+	}
+	return result
+}
+
+// Merge records the presence reported by an instance and returns
+// the combined presence of the user, with whether it changed
+func (t *PresenceTracker) Merge(instance string, presence Presence, now time.Time) (Presence, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := UserKey(presence.Tenant, presence.Username)
+	p, ok := t.cluster[key]
+	if !ok {
+		p = &clusterPresence{
+			tenant:    presence.Tenant,
+			username:  presence.Username,
+			instances: make(map[string]instanceReport),
+			status:    PresenceOffline,
+		}
+		t.cluster[key] = p
+	}
+	if presence.Status == PresenceOffline {
+		delete(p.instances, instance)
+	} else {
+		p.instances[instance] = instanceReport{status: presence.Status, updatedAt: now}
+	}
+	if presence.LastSeen.After(p.lastSeen) {
+		p.lastSeen = presence.LastSeen
+	}
+	changed := p.resolve()
+	return p.presence(), changed
+}
+
+// Prune forgets reports not refreshed within maxAge, e.g. from an instance
+// that crashed, and returns the presences that changed
+func (t *PresenceTracker) Prune(maxAge time.Duration, now time.Time) []Presence {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var changed []Presence
+	for _, p := range t.cluster {
+		for instance, report := range p.instances {
+			if now.Sub(report.updatedAt) > maxAge {
+				delete(p.instances, instance)
+				if report.updatedAt.After(p.lastSeen) {
+					p.lastSeen = report.updatedAt.UTC()
+				}
+			}
+		}
+		if p.resolve() {
+			changed = append(changed, p.presence())
+		}
+	}
+	return changed
+}
+
+func (t *PresenceTracker) Get(tenant, username string) Presence {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	p, ok := t.cluster[UserKey(tenant, username)]
+	if !ok {
+		return Presence{Tenant: tenant, Username: username, Status: PresenceOffline}
+	}
+	return p.presence()
+}
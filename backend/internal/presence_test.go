@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	const grace = 20 * time.Millisecond
+	tests := []struct {
+		name  string
+		steps func(tracker *PresenceTracker, first, second *Client)
+		want  []PresenceStatus
+	}{
+		{
+			name: "reconnect within the grace period",
+			steps: func(tracker *PresenceTracker, first, second *Client) {
+				tracker.Connect(first)
+				tracker.Disconnect(first)
+				tracker.Connect(second)
+				time.Sleep(3 * grace)
+			},
+			want: []PresenceStatus{PresenceOnline},
+		},
+		{
+			name: "offline after the grace period",
+			steps: func(tracker *PresenceTracker, first, _ *Client) {
+				tracker.Connect(first)
+				tracker.Disconnect(first)
+				time.Sleep(3 * grace)
+			},
+			want: []PresenceStatus{PresenceOnline, PresenceOffline},
+		},
+		{
+			name: "away once every connection is",
+			steps: func(tracker *PresenceTracker, first, second *Client) {
+				tracker.Connect(first)
+				tracker.Connect(second)
+				tracker.SetStatus(first, PresenceAway)
+				tracker.SetStatus(second, PresenceAway)
+				tracker.SetStatus(first, PresenceOnline)
+			},
+			want: []PresenceStatus{PresenceOnline, PresenceAway, PresenceOnline},
+		},
+		{
+			name: "away connection left",
+			steps: func(tracker *PresenceTracker, first, second *Client) {
+				tracker.Connect(first)
+				tracker.Connect(second)
+				tracker.SetStatus(second, PresenceAway)
+				tracker.Disconnect(first)
+			},
+			want: []PresenceStatus{PresenceOnline, PresenceAway},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewPresenceTracker(grace)
+			var mutex sync.Mutex
+			var changes []PresenceStatus
+			tracker.OnChange(func(presence Presence) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				changes = append(changes, presence.Status)
+			})
+			first := &Client{tenant: DefaultTenant, username: "alice"}
+			second := &Client{tenant: DefaultTenant, username: "alice"}
+			test.steps(tracker, first, second)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !slices.Equal(changes, test.want) {
+				t.Errorf("changes %v, want %v", changes, test.want)
+			}
+		})
+	}
+}
+
+func TestPresenceTrackerMergesInstances(t *testing.T) {
+	tracker := NewPresenceTracker(time.Second)
+	start := time.Now()
+	report := func(status PresenceStatus) Presence {
+		return Presence{Tenant: DefaultTenant, Username: "alice", Status: status, LastSeen: start}
+	}
+	tests := []struct {
+		name     string
+		instance string
+		report   Presence
+		want     PresenceStatus
+		changed  bool
+	}{
+		{name: "away on one", instance: "a", report: report(PresenceAway), want: PresenceAway, changed: true},
+		{name: "online on another", instance: "b", report: report(PresenceOnline), want: PresenceOnline, changed: true},
+		{name: "offline on the first", instance: "a", report: report(PresenceOffline), want: PresenceOnline},
+		{name: "away on the second", instance: "b", report: report(PresenceAway), want: PresenceAway, changed: true},
+	}
+	for _, test := range tests {
+		presence, changed := tracker.Merge(test.instance, test.report, start)
+		if presence.Status != test.want || changed != test.changed {
+			t.Errorf("%s: %s changed %v, want %s changed %v", test.name, presence.Status, changed, test.want, test.changed)
+		}
+	}
+	if status := tracker.Get("acme", "alice").Status; status != PresenceOffline {
+		t.Errorf("alice of another tenant is %s", status)
+	}
+	// The second instance stopped reporting
+	changed := tracker.Prune(time.Minute, start.Add(2*time.Minute))
+	if len(changed) != 1 || changed[0].Status != PresenceOffline {
+		t.Errorf("pruned %+v, want alice offline", changed)
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RateLimiterMemory = "memory"
+	RateLimiterRedis  = "redis"
+	rateLimitPrefix   = "raccoon:ratelimit:"
+)
+
+// rateLimitedFrames are the frames that write to the message store
+var rateLimitedFrames = []string{
+	FrameMessage,
+	FrameMessageEdit,
+	FrameMessageDelete,
+	FrameReactionAdd,
+	FrameReactionRemove,
+}
+
+// RateLimit is a token bucket holding up to Burst tokens, refilled with Rate tokens per second
+type RateLimit struct {
+	Burst int
+	Rate  float64
+}
+
+// RateLimiter takes tokens from the bucket of a key. When the bucket
+// is empty it returns how long until the next token is refilled.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+	Close() error
+}
+
+func NewRateLimiter(ctx context.Context, config *Config) (RateLimiter, error) {
+	switch config.RateLimiter {
+	case RateLimiterRedis:
+		return NewRedisRateLimiter(ctx, config.RedisUrl)
+	default:
+		return NewMemoryRateLimiter(), nil
+	}
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryRateLimiter keeps the buckets of a single instance
+type MemoryRateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	limits    map[string]RateLimit
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets:   make(map[string]*bucket),
+		limits:    make(map[string]RateLimit),
+		lastSweep: time.Now(),
+	}
+}
+
+func refill(b *bucket, limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	b.updated = now
+}
+
+func (l *MemoryRateLimiter) Allow(_ context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+		l.limits[key] = limit
+	}
+	refill(b, limit, now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		return false, wait, nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// sweep drops the buckets that have filled up again, must be called with the mutex held
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	for key, b := range l.buckets {
+		limit := l.limits[key]
+		refill(b, limit, now)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+			delete(l.limits, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *MemoryRateLimiter) Close() error {
+	return nil
+}
+
+// The bucket is refilled with the time of the Redis server, so the clocks of the instances do not matter
+var allowScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate / 1000)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`)
+
+// RedisRateLimiter shares the buckets between every instance of the service
+type RedisRateLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimiter(ctx context.Context, url string) (*RedisRateLimiter, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err = client.Ping(ctx).Err(); err != nil {
+		ignore(client.Close)
+		return nil, err
+	}
+	return &RedisRateLimiter{client: client}, nil
+}
+
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	result, err := allowScript.Run(ctx, l.client, []string{rateLimitPrefix + key}, limit.Burst, limit.Rate).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+func (l *RedisRateLimiter) Close() error {
+	return l.client.Close()
+}
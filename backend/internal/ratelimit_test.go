@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiters(t *testing.T) {
+	limiters := []struct {
+		name string
+		open func(t *testing.T) RateLimiter
+	}{
+		{
+			name: RateLimiterMemory,
+			open: func(*testing.T) RateLimiter { return NewMemoryRateLimiter() },
+		},
+		{
+			name: RateLimiterRedis,
+			open: func(t *testing.T) RateLimiter {
+				limiter, err := NewRedisRateLimiter(context.Background(), startRedis(t))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return limiter
+			},
+		},
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		// Calls to make at once, the ones after the burst are refused
+		calls   int
+		allowed int
+		// Waits above it can only come from a wrong refill rate
+		maxWait time.Duration
+	}{
+		{name: "within burst", limit: RateLimit{Burst: 5, Rate: 1}, calls: 5, allowed: 5},
+		{name: "over burst", limit: RateLimit{Burst: 3, Rate: 1}, calls: 6, allowed: 3, maxWait: time.Second},
+		{name: "fast refill", limit: RateLimit{Burst: 2, Rate: 10}, calls: 3, allowed: 2, maxWait: 100 * time.Millisecond},
+	}
+	ctx := context.Background()
+	for _, l := range limiters {
+		for _, test := range tests {
+			t.Run(l.name+" "+test.name, func(t *testing.T) {
+				limiter := l.open(t)
+				defer ignore(limiter.Close)
+				allowed := 0
+				for range test.calls {
+					ok, wait, err := limiter.Allow(ctx, "alice", test.limit)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if ok {
+						allowed++
+						continue
+					}
+					if wait <= 0 || wait > test.maxWait {
+						t.Errorf("refused with a wait of %v, want up to %v", wait, test.maxWait)
+					}
+				}
+				if allowed != test.allowed {
+					t.Errorf("allowed %d of %d calls, want %d", allowed, test.calls, test.allowed)
+				}
+				// Every key has a bucket of its own
+				if ok, _, err := limiter.Allow(ctx, "bob", test.limit); err != nil || !ok {
+					t.Errorf("bob was refused: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryRateLimiterRefills(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	limit := RateLimit{Burst: 1, Rate: 100}
+	ctx := context.Background()
+	if ok, _, _ := limiter.Allow(ctx, "alice", limit); !ok {
+		t.Fatal("the first call was refused")
+	}
+	ok, wait, _ := limiter.Allow(ctx, "alice", limit)
+	if ok {
+		t.Fatal("the call after the burst was allowed")
+	}
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _, _ = limiter.Allow(ctx, "alice", limit); !ok {
+		t.Errorf("refused after waiting %v", wait)
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxReactionKinds caps the number of distinct reactions on one message
+	MaxReactionKinds = 64
+	maxEmojiLength   = 32
+)
+
+var (
+	ErrInvalidReaction  = errors.New("invalid reaction")
+	ErrTooManyReactions = errors.New("too many reactions on the message")
+	// errReactionUnchanged means the user had already added or removed the reaction
+	errReactionUnchanged = errors.New("reaction unchanged")
+	shortcodePattern     = regexp.MustCompile(`^:[a-z0-9_+-]{1,32}:$`)
+)
+
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+}
+
+// ValidReaction accepts a :shortcode: or a single emoji, including
+// sequences joined with ZWJ, skin tone modifiers and flags
+func ValidReaction(reaction string) bool {
+	if shortcodePattern.MatchString(reaction) {
+		return true
+	}
+	if reaction == "" || len(reaction) > maxEmojiLength || !utf8.ValidString(reaction) {
+		return false
+	}
+	symbol := false
+	for _, r := range reaction {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case unicode.Is(unicode.Sk, r), unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		case r == '\u200d', r == '\ufe0f', r >= '\U000e0020' && r <= '\U000e007f':
+		// Keycap sequences start with a digit, # or *
+		case r == '#', r == '*', r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return symbol || slices.Contains([]rune(reaction), '\u20e3')
+}
+
+func cloneReactions(reactions []Reaction) []Reaction {
+	if reactions == nil {
+		return nil
+	}
+	copied := make([]Reaction, len(reactions))
+	for i, reaction := range reactions {
+		copied[i] = reaction
+		copied[i].Users = slices.Clone(reaction.Users)
+	}
+	return copied
+}
+
+func (m *Message) React(username, emoji string) error {
+	index := slices.IndexFunc(m.Reactions, func(r Reaction) bool { return r.Emoji == emoji })
+	if index < 0 {
+		if len(m.Reactions) >= MaxReactionKinds {
+			return ErrTooManyReactions
+		}
+		m.Reactions = append(m.Reactions, Reaction{Emoji: emoji})
+		index = len(m.Reactions) - 1
+	}
+	reaction := &m.Reactions[index]
+	if slices.Contains(reaction.Users, username) {
+		return errReactionUnchanged
+	}
+	reaction.Users = append(reaction.Users, username)
+	reaction.Count = len(reaction.Users)
+	return nil
+}
+
+func (m *Message) Unreact(username, emoji string) error {
+	index := slices.IndexFunc(m.Reactions, func(r Reaction) bool { return r.Emoji == emoji })
+	if index < 0 {
+		return errReactionUnchanged
+	}
+	reaction := &m.Reactions[index]
+	user := slices.Index(reaction.Users, username)
+	if user < 0 {
+		return errReactionUnchanged
+	}
+	reaction.Users = slices.Delete(reaction.Users, user, user+1)
+	reaction.Count = len(reaction.Users)
+	if reaction.Count == 0 {
+		m.Reactions = slices.Delete(m.Reactions, index, index+1)
+	}
+	return nil
+}
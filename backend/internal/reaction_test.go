@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestValidReaction(t *testing.T) {
+	tests := []struct {
+		reaction string
+		valid    bool
+	}{
+		{reaction: ":tada:", valid: true},
+		{reaction: ":+1:", valid: true},
+		{reaction: "👍", valid: true},
+		{reaction: "👍🏽", valid: true},
+		{reaction: "👩‍💻", valid: true},
+		{reaction: "🇵🇱", valid: true},
+		{reaction: "❤️", valid: true},
+		{reaction: "1️⃣", valid: true},
+		{reaction: "🏴󠁧󠁢󠁳󠁣󠁴󠁿", valid: true},
+		{reaction: "", valid: false},
+		{reaction: "a", valid: false},
+		{reaction: "1", valid: false},
+		{reaction: "👍 ", valid: false},
+		{reaction: "<b>", valid: false},
+		{reaction: ":Tada:", valid: false},
+		{reaction: "::", valid: false},
+		{reaction: ":" + string(make([]byte, 33)) + ":", valid: false},
+		{reaction: "👍👍👍👍👍👍👍👍👍", valid: false},
+		{reaction: "\xff", valid: false},
+	}
+	for _, test := range tests {
+		t.Run(test.reaction, func(t *testing.T) {
+			if valid := ValidReaction(test.reaction); valid != test.valid {
+				t.Errorf("%q valid %v, want %v", test.reaction, valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestMessageReactions(t *testing.T) {
+	type step struct {
+		username string
+		emoji    string
+		remove   bool
+		err      error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []Reaction
+	}{
+		{
+			name:  "counts users",
+			steps: []step{{username: "alice", emoji: ":tada:"}, {username: "bob", emoji: ":tada:"}},
+			want:  []Reaction{{Emoji: ":tada:", Count: 2, Users: []string{"alice", "bob"}}},
+		},
+		{
+			name:  "same reaction twice",
+			steps: []step{{username: "alice", emoji: ":tada:"}, {username: "alice", emoji: ":tada:", err: errReactionUnchanged}},
+			want:  []Reaction{{Emoji: ":tada:", Count: 1, Users: []string{"alice"}}},
+		},
+		{
+			name: "last user removes the reaction",
+			steps: []step{
+				{username: "alice", emoji: ":tada:"},
+				{username: "alice", emoji: "👍"},
+				{username: "alice", emoji: ":tada:", remove: true},
+			},
+			want: []Reaction{{Emoji: "👍", Count: 1, Users: []string{"alice"}}},
+		},
+		{
+			name:  "removing a missing reaction",
+			steps: []step{{username: "alice", emoji: ":tada:"}, {username: "bob", emoji: ":tada:", remove: true, err: errReactionUnchanged}},
+			want:  []Reaction{{Emoji: ":tada:", Count: 1, Users: []string{"alice"}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := newTestMessage("hello")
+			for _, step := range test.steps {
+				var err error
+				if step.remove {
+					err = message.Unreact(step.username, step.emoji)
+				} else {
+					err = message.React(step.username, step.emoji)
+				}
+				if !errors.Is(err, step.err) {
+					t.Fatalf("%+v got %v", step, err)
+				}
+			}
+			if len(message.Reactions) != len(test.want) {
+				t.Fatalf("reactions %+v, want %+v", message.Reactions, test.want)
+			}
+			for i, reaction := range message.Reactions {
+				want := test.want[i]
+				if reaction.Emoji != want.Emoji || reaction.Count != want.Count || !slices.Equal(reaction.Users, want.Users) {
+					t.Errorf("reaction %+v, want %+v", reaction, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageReactionKindsAreCapped(t *testing.T) {
+	message := newTestMessage("hello")
+	for i := range MaxReactionKinds {
+		if err := message.React("alice", ":r"+strconv.Itoa(i)+":"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := message.React("alice", ":one-more:"); !errors.Is(err, ErrTooManyReactions) {
+		t.Errorf("reaction over the cap got %v", err)
+	}
+	if err := message.React("bob", ":r0:"); err != nil {
+		t.Errorf("reacting with an existing kind got %v", err)
+	}
+}
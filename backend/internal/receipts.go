@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"path/filepath"
+	"sync"
+)
+
+// ReceiptStore keeps the last sequence number every user has read in every room
+type ReceiptStore interface {
+	// MarkRead only ever moves the receipt forward and reports whether it did
+	MarkRead(ctx context.Context, room, tenant, username string, seq uint64) (bool, error)
+	LastRead(ctx context.Context, tenant, username string) (map[string]uint64, error)
+}
+
+func NewReceiptStore(config *Config) (ReceiptStore, error) {
+	switch config.MessageStore {
+	case MessageStoreDisk:
+		return NewLocalReceiptStore(filepath.Join(config.MessageStoreDir, "receipts.json"))
+	case MessageStoreRedis:
+		return NewRedisReceiptStore(config.RedisUrl)
+	default:
+		return NewLocalReceiptStore("")
+	}
+}
+
+// LocalReceiptStore keeps receipts in memory by UserKey, with a non-empty
+// path they are also kept in a Journal there
+type LocalReceiptStore struct {
+	mutex   sync.RWMutex
+	journal *Journal
+	users   map[string]map[string]uint64
+}
+
+type receiptChange struct {
+	User string `json:"user"`
+	Room string `json:"room"`
+	Seq  uint64 `json:"seq"`
+}
+
+func NewLocalReceiptStore(path string) (*LocalReceiptStore, error) {
+	store := &LocalReceiptStore{
+		users: make(map[string]map[string]uint64),
+	}
+	if path == "" {
+		return store, nil
+	}
+	journal, err := OpenJournal(path, &store.users, func(data []byte) error {
+		var change receiptChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			return err
+		}
+		store.advance(change.User, change.Room, change.Seq)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+	return store, nil
+}
+
+func (s *LocalReceiptStore) advance(key, room string, seq uint64) (uint64, bool) {
+	rooms, ok := s.users[key]
+	if !ok {
+		rooms = make(map[string]uint64)
+		s.users[key] = rooms
+	}
+	previous := rooms[room]
+	if seq <= previous {
+		return previous, false
+	}
+	rooms[room] = seq
+	return previous, true
+}
+
+func (s *LocalReceiptStore) MarkRead(_ context.Context, room, tenant, username string, seq uint64) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := UserKey(tenant, username)
+	previous, advanced := s.advance(key, room, seq)
+	if !advanced || s.journal == nil {
+		return advanced, nil
+	}
+	if err := s.journal.Append(s.users, receiptChange{User: key, Room: room, Seq: seq}); err != nil {
+		s.users[key][room] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LocalReceiptStore) LastRead(_ context.Context, tenant, username string) (map[string]uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return maps.Clone(s.users[UserKey(tenant, username)]), nil
+}
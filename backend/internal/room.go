@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 3
+	case RoleModerator:
+		return 2
+	case RoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (r Role) AtLeast(other Role) bool {
+	return r.rank() >= other.rank()
+}
+
+type Permission int
+
+const (
+	// PermissionRead allows reading history and receiving live messages
+	PermissionRead Permission = iota
+	// PermissionPost allows sending messages
+	PermissionPost
+	// PermissionModerate allows renaming the room, managing members and other people's messages
+	PermissionModerate
+	// PermissionAdminister allows archiving the room and changing roles
+	PermissionAdminister
+)
+
+const (
+	RoomKindGroup  = "group"
+	RoomKindDirect = "direct"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomExists   = errors.New("room already exists")
+)
+
+// Room belongs to the tenant of its creator, users of other tenants never see it
+type Room struct {
+	Id        string          `json:"id"`
+	Tenant    string          `json:"tenant"`
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Private   bool            `json:"private"`
+	Archived  bool            `json:"archived"`
+	CreatedBy string          `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+	Members   map[string]Role `json:"members"`
+	// Invited maps invited usernames to whoever invited them
+	Invited map[string]string `json:"invited,omitempty"`
+}
+
+func (r *Room) Can(username string, permission Permission) bool {
+	role, ok := r.Members[username]
+	if !ok {
+		return false
+	}
+	switch permission {
+	case PermissionRead:
+		return true
+	case PermissionPost:
+		return !r.Archived
+	case PermissionModerate:
+		return !r.Archived && !r.IsDirect() && role.AtLeast(RoleModerator)
+	case PermissionAdminister:
+		return !r.IsDirect() && role == RoleOwner
+	default:
+		return false
+	}
+}
+
+func (r *Room) IsDirect() bool {
+	return r.Kind == RoomKindDirect
+}
+
+func (r *Room) CanJoin(username string) bool {
+	if r.Archived {
+		return false
+	}
+	if _, ok := r.Invited[username]; ok {
+		return true
+	}
+	return !r.Private
+}
+
+func (r *Room) Owners() int {
+	owners := 0
+	for _, role := range r.Members {
+		if role == RoleOwner {
+			owners++
+		}
+	}
+	return owners
+}
+
+// SharesRoom reports whether two users of the tenant are members of a common room
+func SharesRoom(ctx context.Context, store RoomStore, tenant, a, b string) (bool, error) {
+	rooms, err := store.MemberOf(ctx, tenant, a)
+	if err != nil {
+		return false, err
+	}
+	for _, room := range rooms {
+		if _, ok := room.Members[b]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Room) clone() *Room {
+	copied := *r
+	copied.Members = maps.Clone(r.Members)
+	copied.Invited = maps.Clone(r.Invited)
+	return &copied
+}
+
+type RoomStore interface {
+	Create(ctx context.Context, room *Room) error
+	Get(ctx context.Context, id string) (*Room, error)
+	List(ctx context.Context, filter func(room *Room) bool) ([]*Room, error)
+	// MemberOf returns the rooms of the tenant the user is a member of
+	// without going through every room
+	MemberOf(ctx context.Context, tenant, username string) ([]*Room, error)
+	// Update applies fn to a copy of the room and stores it unless fn fails
+	Update(ctx context.Context, id string, fn func(room *Room) error) (*Room, error)
+}
+
+func NewRoomStore(config *Config) (RoomStore, error) {
+	switch config.MessageStore {
+	case MessageStoreDisk:
+		return NewLocalRoomStore(filepath.Join(config.MessageStoreDir, "rooms.json"))
+	case MessageStoreRedis:
+		return NewRedisRoomStore(config.RedisUrl)
+	default:
+		return NewLocalRoomStore("")
+	}
+}
+
+// LocalRoomStore keeps rooms in memory. With a non-empty path every change
+// is also kept in a Journal there so rooms survive a restart.
+type LocalRoomStore struct {
+	mutex   sync.RWMutex
+	journal *Journal
+	rooms   map[string]*Room
+	// members maps the UserKey of every member to the ids of its rooms
+	members map[string]map[string]struct{}
+}
+
+func NewLocalRoomStore(path string) (*LocalRoomStore, error) {
+	store := &LocalRoomStore{
+		rooms:   make(map[string]*Room),
+		members: make(map[string]map[string]struct{}),
+	}
+	if path == "" {
+		return store, nil
+	}
+	// Every change is the whole room after it
+	journal, err := OpenJournal(path, &store.rooms, func(data []byte) error {
+		var room Room
+		if err := json.Unmarshal(data, &room); err != nil {
+			return err
+		}
+		store.rooms[room.Id] = &room
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.journal = journal
+	for _, room := range store.rooms {
+		store.index(nil, room)
+	}
+	return store, nil
+}
+
+// index moves the room from the members of previous, if any, to its current members
+func (s *LocalRoomStore) index(previous, room *Room) {
+	if previous != nil {
+		for username := range previous.Members {
+			if _, ok := room.Members[username]; ok {
+				continue
+			}
+			key := UserKey(previous.Tenant, username)
+			delete(s.members[key], room.Id)
+			if len(s.members[key]) == 0 {
+				delete(s.members, key)
+			}
+		}
+	}
+	for username := range room.Members {
+		key := UserKey(room.Tenant, username)
+		if s.members[key] == nil {
+			s.members[key] = make(map[string]struct{})
+		}
+		s.members[key][room.Id] = struct{}{}
+	}
+}
+
+func (s *LocalRoomStore) persist(room *Room) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal.Append(s.rooms, room)
+}
+
+func (s *LocalRoomStore) Create(_ context.Context, room *Room) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.rooms[room.Id]; ok {
+		return ErrRoomExists
+	}
+	s.rooms[room.Id] = room.clone()
+	if err := s.persist(room); err != nil {
+		delete(s.rooms, room.Id)
+		return err
+	}
+	s.index(nil, room)
+	return nil
+}
+
+func (s *LocalRoomStore) Get(_ context.Context, id string) (*Room, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	room, ok := s.rooms[id]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	return room.clone(), nil
+}
+
+func (s *LocalRoomStore) List(_ context.Context, filter func(room *Room) bool) ([]*Room, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []*Room
+	for _, room := range s.rooms {
+		if filter(room) {
+			result = append(result, room.clone())
+		}
+	}
+	return result, nil
+}
+
+func (s *LocalRoomStore) MemberOf(_ context.Context, tenant, username string) ([]*Room, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []*Room
+	for id := range s.members[UserKey(tenant, username)] {
+		result = append(result, s.rooms[id].clone())
+	}
+	return result, nil
+}
+
+func (s *LocalRoomStore) Update(
+	_ context.Context,
+	id string,
+	fn func(room *Room) error,
+) (*Room, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.rooms[id]
+	if !ok {
+		return nil, ErrRoomNotFound
+	}
+	updated := current.clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	s.rooms[id] = updated
+	if err := s.persist(updated); err != nil {
+		s.rooms[id] = current
+		return nil, err
+	}
+	s.index(current, updated)
+	return updated.clone(), nil
+}
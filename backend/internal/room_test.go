@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func roomIds(rooms []*Room) []string {
+	ids := make([]string, len(rooms))
+	for i, room := range rooms {
+		ids[i] = room.Id
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestRoomStoreMemberOf(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) RoomStore
+		// reopen returns the store as it is read back, if it survives a restart
+		reopen func(t *testing.T, store RoomStore) RoomStore
+	}{
+		{
+			name: "memory",
+			open: func(t *testing.T) RoomStore {
+				store, err := NewLocalRoomStore("")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+			reopen: func(_ *testing.T, store RoomStore) RoomStore { return store },
+		},
+		{
+			name: "journal",
+			open: func(t *testing.T) RoomStore {
+				return openLocalStores(t, t.TempDir()).rooms
+			},
+			reopen: func(t *testing.T, store RoomStore) RoomStore {
+				return openLocalStores(t, filepath.Dir(store.(*LocalRoomStore).journal.path)).rooms
+			},
+		},
+		{
+			name: "redis",
+			open: func(t *testing.T) RoomStore {
+				store, err := NewRedisRoomStore(startRedis(t))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+			reopen: func(_ *testing.T, store RoomStore) RoomStore { return store },
+		},
+	}
+	rooms := []*Room{
+		{Id: "general", Tenant: DefaultTenant, Members: map[string]Role{"alice": RoleOwner, "bob": RoleMember}},
+		{Id: "random", Tenant: DefaultTenant, Members: map[string]Role{"alice": RoleOwner, "carol": RoleMember}},
+		{Id: "acme", Tenant: "acme", Members: map[string]Role{"alice": RoleOwner, "bob": RoleMember}},
+	}
+	ctx := context.Background()
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			store := s.open(t)
+			for _, room := range rooms {
+				if err := store.Create(ctx, room); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := store.Update(ctx, "general", func(room *Room) error {
+				delete(room.Members, "bob")
+				room.Members["dave"] = RoleMember
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store = s.reopen(t, store)
+			want := map[string][]string{
+				"alice": {"general", "random"},
+				"bob":   {},
+				"carol": {"random"},
+				"dave":  {"general"},
+			}
+			for username, ids := range want {
+				member, err := store.MemberOf(ctx, DefaultTenant, username)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := roomIds(member); !slices.Equal(got, ids) {
+					t.Errorf("%s is a member of %v, want %v", username, got, ids)
+				}
+			}
+			member, err := store.MemberOf(ctx, "acme", "bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := roomIds(member); !slices.Equal(got, []string{"acme"}) {
+				t.Errorf("bob of acme is a member of %v, want [acme]", got)
+			}
+			shared, err := SharesRoom(ctx, store, DefaultTenant, "carol", "dave")
+			if err != nil || shared {
+				t.Errorf("carol and dave share a room: %v, %v", shared, err)
+			}
+		})
+	}
+}
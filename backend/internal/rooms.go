@@ -0,0 +1,502 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 200
+)
+
+var (
+	errForbidden     = errors.New("forbidden")
+	errLastOwner     = errors.New("room must keep at least one owner")
+	errNotInvited    = errors.New("room is private")
+	errAlreadyJoined = errors.New("already a member")
+	errInvalidLimit  = errors.New("invalid limit")
+)
+
+type RoomsRouter struct {
+	logger   *zap.Logger
+	router   *mux.Router
+	store    MessageStore
+	rooms    RoomStore
+	receipts ReceiptStore
+	hub      *Hub
+}
+
+func NewRoomsRouter(logger *zap.Logger,
+	rootRouter *mux.Router,
+	validator *TokenValidator,
+	store MessageStore,
+	rooms RoomStore,
+	receipts ReceiptStore,
+	hub *Hub) *RoomsRouter {
+	router := rootRouter.PathPrefix("/rooms").Subrouter()
+	router.Use(validator.ValidatingMiddleware)
+	roomsRouter := &RoomsRouter{logger: logger,
+		router:   router,
+		store:    store,
+		rooms:    rooms,
+		receipts: receipts,
+		hub:      hub}
+	roomsRouter.registerRoutes()
+	return roomsRouter
+}
+
+func (r *RoomsRouter) registerRoutes() {
+	r.router.HandleFunc("", r.ListRooms).Methods("GET")
+	r.router.HandleFunc("", r.CreateRoom).Methods("POST")
+	r.router.HandleFunc("/unread", r.GetUnread).Methods("GET")
+	r.router.HandleFunc("/{id}", r.GetRoom).Methods("GET")
+	r.router.HandleFunc("/{id}", r.RenameRoom).Methods("PATCH")
+	r.router.HandleFunc("/{id}/archive", r.ArchiveRoom).Methods("POST")
+	r.router.HandleFunc("/{id}/join", r.JoinRoom).Methods("POST")
+	r.router.HandleFunc("/{id}/leave", r.LeaveRoom).Methods("POST")
+	r.router.HandleFunc("/{id}/invites", r.InviteMember).Methods("POST")
+	r.router.HandleFunc("/{id}/members/{username}", r.SetMemberRole).Methods("PUT")
+	r.router.HandleFunc("/{id}/members/{username}", r.RemoveMember).Methods("DELETE")
+	r.router.HandleFunc("/{id}/messages", r.GetMessages).Methods("GET")
+	r.router.HandleFunc("/{id}/threads/{messageId}", r.GetThread).Methods("GET")
+}
+
+type CreateRoomRequest struct {
+	Name    string `json:"name"    validate:"required,max=100"`
+	Private bool   `json:"private"`
+}
+
+type RenameRoomRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+type InviteRequest struct {
+	Username string `json:"username" validate:"required,max=128"`
+}
+
+type SetRoleRequest struct {
+	Role Role `json:"role" validate:"required,oneof=owner moderator member"`
+}
+
+func (r *RoomsRouter) writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, errForbidden), errors.Is(err, errNotInvited):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, errLastOwner), errors.Is(err, errAlreadyJoined):
+		WriteString(w, err.Error(), http.StatusConflict)
+	default:
+		r.logger.Error("rooms request failed", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// loadRoom fetches the room from the path. Rooms of other tenants and private
+// rooms are reported as missing to anyone who is neither a member nor invited.
+func (r *RoomsRouter) loadRoom(w http.ResponseWriter, req *http.Request) (*Room, string, bool) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, "", false
+	}
+	room, err := r.rooms.Get(req.Context(), mux.Vars(req)["id"])
+	if err != nil {
+		r.writeError(w, err)
+		return nil, "", false
+	}
+	_, member := room.Members[username]
+	_, invited := room.Invited[username]
+	if room.Tenant != GetTenant(req) || room.Private && !member && !invited {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, "", false
+	}
+	return room, username, true
+}
+
+// updateRoom loads the room for access checks and then applies fn atomically
+func (r *RoomsRouter) updateRoom(w http.ResponseWriter,
+	req *http.Request,
+	fn func(room *Room, username string) error) (*Room, bool) {
+	_, username, ok := r.loadRoom(w, req)
+	if !ok {
+		return nil, false
+	}
+	room, err := r.rooms.Update(req.Context(), mux.Vars(req)["id"], func(room *Room) error {
+		return fn(room, username)
+	})
+	if err != nil {
+		r.writeError(w, err)
+		return nil, false
+	}
+	return room, true
+}
+
+func (r *RoomsRouter) ListRooms(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tenant := GetTenant(req)
+	var rooms []*Room
+	if req.URL.Query().Get("public") == "true" {
+		rooms, err = r.rooms.List(req.Context(), func(room *Room) bool {
+			return room.Tenant == tenant && !room.Private && !room.Archived
+		})
+	} else {
+		rooms, err = r.rooms.MemberOf(req.Context(), tenant, username)
+	}
+	if err != nil {
+		r.writeError(w, err)
+		return
+	}
+	slices.SortFunc(rooms, func(a, b *Room) int {
+		return cmp.Compare(a.CreatedAt.UnixNano(), b.CreatedAt.UnixNano())
+	})
+	if rooms == nil {
+		rooms = []*Room{}
+	}
+	WriteJSON(w, rooms, http.StatusOK)
+}
+
+func (r *RoomsRouter) CreateRoom(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var request CreateRoomRequest
+	if err = ReadJSON(w, req, &request); err != nil {
+		WriteString(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	room := &Room{
+		Id:        uuid.NewString(),
+		Tenant:    GetTenant(req),
+		Kind:      RoomKindGroup,
+		Name:      request.Name,
+		Private:   request.Private,
+		CreatedBy: username,
+		CreatedAt: time.Now().UTC(),
+		Members:   map[string]Role{username: RoleOwner},
+	}
+	if err = r.rooms.Create(req.Context(), room); err != nil {
+		r.writeError(w, err)
+		return
+	}
+	WriteJSON(w, room, http.StatusCreated)
+}
+
+func (r *RoomsRouter) GetRoom(w http.ResponseWriter, req *http.Request) {
+	room, _, ok := r.loadRoom(w, req)
+	if !ok {
+		return
+	}
+	WriteJSON(w, room, http.StatusOK)
+}
+
+func (r *RoomsRouter) RenameRoom(w http.ResponseWriter, req *http.Request) {
+	var request RenameRoomRequest
+	if err := ReadJSON(w, req, &request); err != nil {
+		WriteString(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		if !room.Can(username, PermissionModerate) {
+			return errForbidden
+		}
+		room.Name = request.Name
+		return nil
+	})
+	if ok {
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+func (r *RoomsRouter) ArchiveRoom(w http.ResponseWriter, req *http.Request) {
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		if !room.Can(username, PermissionAdminister) {
+			return errForbidden
+		}
+		room.Archived = true
+		return nil
+	})
+	if ok {
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+func (r *RoomsRouter) JoinRoom(w http.ResponseWriter, req *http.Request) {
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		if _, ok := room.Members[username]; ok {
+			return errAlreadyJoined
+		}
+		if !room.CanJoin(username) {
+			return errNotInvited
+		}
+		room.Members[username] = RoleMember
+		delete(room.Invited, username)
+		return nil
+	})
+	if ok {
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+func (r *RoomsRouter) LeaveRoom(w http.ResponseWriter, req *http.Request) {
+	var leaving string
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		role, ok := room.Members[username]
+		if !ok || room.IsDirect() {
+			return errForbidden
+		}
+		if role == RoleOwner && room.Owners() == 1 && len(room.Members) > 1 {
+			return errLastOwner
+		}
+		delete(room.Members, username)
+		leaving = username
+		return nil
+	})
+	if ok {
+		r.hub.Evict(room, leaving)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (r *RoomsRouter) InviteMember(w http.ResponseWriter, req *http.Request) {
+	var request InviteRequest
+	if err := ReadJSON(w, req, &request); err != nil {
+		WriteString(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		permission := PermissionPost
+		if room.Private {
+			permission = PermissionModerate
+		}
+		if !room.Can(username, permission) {
+			return errForbidden
+		}
+		if _, ok := room.Members[request.Username]; ok {
+			return errAlreadyJoined
+		}
+		if room.Invited == nil {
+			room.Invited = make(map[string]string)
+		}
+		room.Invited[request.Username] = username
+		return nil
+	})
+	if ok {
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+func (r *RoomsRouter) SetMemberRole(w http.ResponseWriter, req *http.Request) {
+	var request SetRoleRequest
+	if err := ReadJSON(w, req, &request); err != nil {
+		WriteString(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	target := mux.Vars(req)["username"]
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		if !room.Can(username, PermissionAdminister) {
+			return errForbidden
+		}
+		current, ok := room.Members[target]
+		if !ok {
+			return ErrRoomNotFound
+		}
+		if current == RoleOwner && request.Role != RoleOwner && room.Owners() == 1 {
+			return errLastOwner
+		}
+		room.Members[target] = request.Role
+		return nil
+	})
+	if ok {
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+// RemoveMember lets moderators remove anyone ranked below them
+func (r *RoomsRouter) RemoveMember(w http.ResponseWriter, req *http.Request) {
+	target := mux.Vars(req)["username"]
+	room, ok := r.updateRoom(w, req, func(room *Room, username string) error {
+		if !room.Can(username, PermissionModerate) {
+			return errForbidden
+		}
+		role, ok := room.Members[target]
+		if !ok {
+			return ErrRoomNotFound
+		}
+		if role.AtLeast(room.Members[username]) {
+			return errForbidden
+		}
+		delete(room.Members, target)
+		return nil
+	})
+	if ok {
+		r.hub.Evict(room, target)
+		WriteJSON(w, room, http.StatusOK)
+	}
+}
+
+type UnreadResponse struct {
+	Room     string `json:"room"`
+	LastRead uint64 `json:"last_read"`
+	LastSeq  uint64 `json:"last_seq"`
+	Unread   uint64 `json:"unread"`
+}
+
+func (r *RoomsRouter) GetUnread(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tenant := GetTenant(req)
+	rooms, err := r.rooms.MemberOf(req.Context(), tenant, username)
+	if err != nil {
+		r.writeError(w, err)
+		return
+	}
+	lastRead, err := r.receipts.LastRead(req.Context(), tenant, username)
+	if err != nil {
+		r.writeError(w, err)
+		return
+	}
+	response := make([]UnreadResponse, 0, len(rooms))
+	for _, room := range rooms {
+		lastSeq, err := r.store.LastSeq(req.Context(), room.Id)
+		if err != nil {
+			r.writeError(w, err)
+			return
+		}
+		read := min(lastRead[room.Id], lastSeq)
+		response = append(response, UnreadResponse{
+			Room:     room.Id,
+			LastRead: read,
+			LastSeq:  lastSeq,
+			Unread:   lastSeq - read,
+		})
+	}
+	slices.SortFunc(response, func(a, b UnreadResponse) int {
+		return cmp.Compare(a.Room, b.Room)
+	})
+	WriteJSON(w, response, http.StatusOK)
+}
+
+type HistoryResponse struct {
+	Messages []*Message `json:"messages"`
+	// Next is the cursor of the previous page, empty once the beginning of the room is reached
+	Next string `json:"next,omitempty"`
+}
+
+func parseHistoryQuery(req *http.Request) (HistoryQuery, error) {
+	query := HistoryQuery{Limit: DefaultHistoryLimit}
+	params := req.URL.Query()
+	if before := params.Get("before"); before != "" {
+		seq, err := DecodeCursor(before)
+		if err != nil {
+			return query, err
+		}
+		query.Before = seq
+	}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return query, errInvalidLimit
+		}
+		query.Limit = min(value, MaxHistoryLimit)
+	}
+	return query, nil
+}
+
+func (r *RoomsRouter) GetMessages(w http.ResponseWriter, req *http.Request) {
+	room, username, ok := r.loadRoom(w, req)
+	if !ok {
+		return
+	}
+	if !room.Can(username, PermissionRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query, err := parseHistoryQuery(req)
+	if err != nil {
+		WriteString(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	messages, err := r.store.History(req.Context(), room.Id, query)
+	if err != nil {
+		r.logger.Error("failed to load history", zap.String("room", room.Id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := &HistoryResponse{Messages: messages}
+	if len(messages) > 0 && messages[0].Seq > 1 {
+		response.Next = EncodeCursor(messages[0].Seq)
+	}
+	WriteJSON(w, response, http.StatusOK)
+}
+
+type ThreadResponse struct {
+	Parent   *Message   `json:"parent"`
+	Messages []*Message `json:"messages"`
+	Next     string     `json:"next,omitempty"`
+}
+
+func (r *RoomsRouter) GetThread(w http.ResponseWriter, req *http.Request) {
+	room, username, ok := r.loadRoom(w, req)
+	if !ok {
+		return
+	}
+	if !room.Can(username, PermissionRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	query, err := parseHistoryQuery(req)
+	if err != nil {
+		WriteString(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	parent, err := r.store.Get(req.Context(), room.Id, mux.Vars(req)["messageId"])
+	if err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.logger.Error("failed to load thread parent", zap.String("room", room.Id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Threads are one level deep, replies to a reply go to the thread of its parent
+	if parent.ParentId != "" {
+		WriteString(w, "message is a reply in the thread of "+parent.ParentId, http.StatusBadRequest)
+		return
+	}
+	query.Thread = parent.Id
+	messages, err := r.store.History(req.Context(), room.Id, query)
+	if err != nil {
+		r.logger.Error("failed to load thread", zap.String("room", room.Id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := &ThreadResponse{Parent: parent, Messages: messages}
+	if len(messages) > 0 && messages[0].Seq > parent.Seq+1 {
+		response.Next = EncodeCursor(messages[0].Seq)
+	}
+	WriteJSON(w, response, http.StatusOK)
+}
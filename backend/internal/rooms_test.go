@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// roomsRouter serves the rooms API of the hub without checking tokens
+func (h *testHub) roomsRouter() http.Handler {
+	root := mux.NewRouter()
+	rooms := &RoomsRouter{
+		logger:   zap.NewNop(),
+		router:   root.PathPrefix("/rooms").Subrouter(),
+		store:    h.store,
+		rooms:    h.rooms,
+		receipts: h.receipts,
+		hub:      h.Hub,
+	}
+	rooms.registerRoutes()
+	return root
+}
+
+// serveAs sends the request as a user of the tenant, the token is already validated
+func serveAs(handler http.Handler, tenant, username, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	token := &jwt.Token{Claims: jwt.MapClaims{CognitoUsernameClaim: username}, Valid: true}
+	req = req.WithContext(WithParsedToken(req.Context(), token, tenant))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRoomRoles(t *testing.T) {
+	tests := []struct {
+		name     string
+		private  bool
+		invited  []string
+		tenant   string
+		username string
+		method   string
+		path     string
+		body     string
+		status   int
+	}{
+		{name: "member renames", username: "bob", method: "PATCH", path: "", body: `{"name":"new"}`, status: http.StatusForbidden},
+		{name: "moderator renames", username: "mod", method: "PATCH", path: "", body: `{"name":"new"}`, status: http.StatusOK},
+		{name: "moderator archives", username: "mod", method: "POST", path: "/archive", status: http.StatusForbidden},
+		{name: "owner archives", username: "alice", method: "POST", path: "/archive", status: http.StatusOK},
+		{name: "moderator removes a member", username: "mod", method: "DELETE", path: "/members/bob", status: http.StatusOK},
+		{name: "moderator removes the owner", username: "mod", method: "DELETE", path: "/members/alice", status: http.StatusForbidden},
+		{name: "member removes a member", username: "bob", method: "DELETE", path: "/members/carol", status: http.StatusForbidden},
+		{name: "owner promotes", username: "alice", method: "PUT", path: "/members/bob", body: `{"role":"moderator"}`, status: http.StatusOK},
+		{name: "moderator promotes", username: "mod", method: "PUT", path: "/members/bob", body: `{"role":"owner"}`, status: http.StatusForbidden},
+		{name: "unknown role", username: "alice", method: "PUT", path: "/members/bob", body: `{"role":"admin"}`, status: http.StatusBadRequest},
+		{name: "last owner steps down", username: "alice", method: "PUT", path: "/members/alice", body: `{"role":"member"}`, status: http.StatusConflict},
+		{name: "last owner leaves", username: "alice", method: "POST", path: "/leave", status: http.StatusConflict},
+		{name: "member leaves", username: "bob", method: "POST", path: "/leave", status: http.StatusNoContent},
+		{name: "outsider joins", username: "eve", method: "POST", path: "/join", status: http.StatusOK},
+		{name: "member joins again", username: "bob", method: "POST", path: "/join", status: http.StatusConflict},
+		{name: "outsider joins a private room", private: true, username: "eve", method: "POST", path: "/join", status: http.StatusNotFound},
+		{name: "invited joins a private room", private: true, invited: []string{"eve"}, username: "eve", method: "POST", path: "/join", status: http.StatusOK},
+		{name: "member invites to a private room", private: true, username: "bob", method: "POST", path: "/invites", body: `{"username":"eve"}`, status: http.StatusForbidden},
+		{name: "moderator invites to a private room", private: true, username: "mod", method: "POST", path: "/invites", body: `{"username":"eve"}`, status: http.StatusOK},
+		{name: "same user of another tenant", tenant: "acme", username: "alice", method: "GET", path: "", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hub := newTestHub(t)
+			room := &Room{
+				Id:      testRoom,
+				Tenant:  DefaultTenant,
+				Kind:    RoomKindGroup,
+				Private: test.private,
+				Members: map[string]Role{"alice": RoleOwner, "mod": RoleModerator, "bob": RoleMember, "carol": RoleMember},
+				Invited: make(map[string]string),
+			}
+			for _, username := range test.invited {
+				room.Invited[username] = "alice"
+			}
+			if err := hub.rooms.Create(context.Background(), room); err != nil {
+				t.Fatal(err)
+			}
+			tenant := test.tenant
+			if tenant == "" {
+				tenant = DefaultTenant
+			}
+			response := serveAs(hub.roomsRouter(), tenant, test.username, test.method, "/rooms/"+testRoom+test.path, test.body)
+			if response.Code != test.status {
+				t.Errorf("status %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+		})
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	hub := newTestHub(t)
+	hub.createRoom(t, testRoom, "alice")
+	root := newTestMessage("root")
+	if err := hub.store.Append(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	reply := newTestMessage("reply")
+	reply.ParentId = root.Id
+	if err := hub.store.Append(context.Background(), reply); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		id      string
+		status  int
+		replies int
+	}{
+		{name: "top-level message", id: root.Id, status: http.StatusOK, replies: 1},
+		{name: "reply", id: reply.Id, status: http.StatusBadRequest},
+		{name: "missing message", id: "missing", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serveAs(hub.roomsRouter(), DefaultTenant, "alice", "GET", "/rooms/"+testRoom+"/threads/"+test.id, "")
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var thread ThreadResponse
+			if err := json.Unmarshal(response.Body.Bytes(), &thread); err != nil {
+				t.Fatal(err)
+			}
+			if thread.Parent.Id != root.Id || len(thread.Messages) != test.replies {
+				t.Errorf("thread of %s with %d replies, want %d", thread.Parent.Id, len(thread.Messages), test.replies)
+			}
+		})
+	}
+}
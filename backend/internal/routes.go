@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -11,16 +12,40 @@ import (
 func SetupRoutes(config *Config,
 	awsCfg *aws.Config,
 	logger *zap.Logger,
-	validator *TokenValidator) *mux.Router {
+	validator *TokenValidator,
+	store MessageStore,
+	roomStore RoomStore,
+	receipts ReceiptStore,
+	mentions MentionStore,
+	broker Broker,
+	limiter RateLimiter) (*mux.Router, *Hub, error) {
 	router := mux.NewRouter()
 	requestLogger := &RequestLogger{logger}
 	router.Use(requestLogger.loggingMiddleware)
 	router.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		WriteString(w, "OK", http.StatusOK)
 	})
+	router.Handle("/metrics", expvar.Handler())
+	router.HandleFunc("/diagnostics/jwks", validator.GetJwksDiagnostics).Methods("GET")
 	apiRouter := router.PathPrefix(config.ApiPathPrefix).Subrouter()
 	wsRouter := router.PathPrefix(config.WsPathPrefix).Subrouter()
-	NewChatRouter(logger, wsRouter, validator)
-	NewUsersRouter(config, logger, apiRouter, awsCfg, validator)
-	return router
+	directory := NewUserDirectory(config, awsCfg)
+	dms := NewDirectMessages(roomStore, directory)
+	presence := NewPresenceTracker(config.PresenceOfflineGrace)
+	typing := NewTypingTracker(config.TypingTimeout, config.TypingInterval, config.TypingMaxPerSecond)
+	hub, err := NewHub(config, logger, store, roomStore, dms, presence, typing, receipts, mentions, broker, limiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	tickets, err := NewTicketStore(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	go hub.SyncPresence(config.PresenceSyncInterval)
+	NewChatRouter(config, logger, wsRouter, apiRouter, validator, tickets, hub)
+	NewUsersRouter(config, logger, apiRouter, awsCfg, validator, directory, presence, roomStore)
+	NewRoomsRouter(logger, apiRouter, validator, store, roomStore, receipts, hub)
+	NewDirectMessagesRouter(logger, apiRouter, validator, dms)
+	NewMentionsRouter(logger, apiRouter, validator, mentions, store, roomStore)
+	return router, hub, nil
 }
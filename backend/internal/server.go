@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"go.uber.org/zap"
@@ -15,6 +17,12 @@ type Server struct {
 	Config         *Config
 	logger         *zap.Logger
 	tokenValidator *TokenValidator
+	messageStore   MessageStore
+	roomStore      RoomStore
+	receiptStore   ReceiptStore
+	mentionStore   MentionStore
+	broker         Broker
+	rateLimiter    RateLimiter
 	AwsConfig      *aws.Config
 }
 
@@ -39,27 +47,98 @@ func NewServer(config *Config, awsConfig *aws.Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	messageStore, err := NewMessageStore(config)
+	if err != nil {
+		return nil, err
+	}
+	roomStore, err := NewRoomStore(config)
+	if err != nil {
+		return nil, err
+	}
+	receiptStore, err := NewReceiptStore(config)
+	if err != nil {
+		return nil, err
+	}
+	mentionStore, err := NewMentionStore(config)
+	if err != nil {
+		return nil, err
+	}
+	broker, err := NewBroker(context.Background(), config, logger)
+	if err != nil {
+		return nil, err
+	}
+	rateLimiter, err := NewRateLimiter(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
 	return &Server{
 		Config:         config,
 		logger:         logger,
 		tokenValidator: tokenValidator,
+		messageStore:   messageStore,
+		roomStore:      roomStore,
+		receiptStore:   receiptStore,
+		mentionStore:   mentionStore,
+		broker:         broker,
+		rateLimiter:    rateLimiter,
 		AwsConfig:      awsConfig,
 	}, nil
 }
 
 func (s *Server) Serve() {
 	defer ignore(s.logger.Sync)
-	router := SetupRoutes(s.Config, s.AwsConfig, s.logger, s.tokenValidator)
-	http.Handle("/", router)
+	defer ignore(s.messageStore.Close)
+	defer ignore(s.broker.Close)
+	defer ignore(s.rateLimiter.Close)
+	router, hub, err := SetupRoutes(s.Config,
+		s.AwsConfig,
+		s.logger,
+		s.tokenValidator,
+		s.messageStore,
+		s.roomStore,
+		s.receiptStore,
+		s.mentionStore,
+		s.broker,
+		s.rateLimiter)
+	if err != nil {
+		s.logger.Error("Failed to set up routes", zap.Error(err))
+		os.Exit(1)
+	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.Config.Port))
 	if err != nil {
 		s.logger.Error("Failed to listen", zap.Error(err))
 		os.Exit(1)
 	}
 	fmt.Printf("Listening on port %d\n", s.Config.Port)
-	err = http.Serve(listener, nil)
-	if err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go s.tokenValidator.RefreshJwks(ctx)
+	server := &http.Server{Handler: router}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	select {
+	case err = <-errs:
 		s.logger.Error("Failed to start server", zap.Error(err))
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	s.drain(server, hub)
+}
+
+// drain stops accepting connections and asks the chat clients to reconnect,
+// giving them up to ShutdownDrainTimeout to go before the server exits
+func (s *Server) drain(server *http.Server, hub *Hub) {
+	s.logger.Info("Shutting down", zap.Duration("drainTimeout", s.Config.ShutdownDrainTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownDrainTimeout)
+	defer cancel()
+	hub.Drain()
+	// Shutdown leaves the hijacked websocket connections to the hub
+	if err := server.Shutdown(ctx); err != nil {
+		s.logger.Warn("Failed to close HTTP connections", zap.Error(err))
+	}
+	if err := hub.Wait(ctx); err != nil {
+		s.logger.Warn("Chat connections left open at the drain deadline", zap.Error(err))
 	}
 }
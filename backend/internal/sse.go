@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderLastEventId      = "Last-Event-ID"
+	HeaderChatConnection   = "X-Chat-Connection"
+	ContentTypeEventStream = "text/event-stream"
+	// EventConnected opens every stream with the id to send frames with
+	EventConnected = "connected"
+	// EventClose ends the stream with the code a WebSocket would be closed with
+	EventClose = "close"
+)
+
+// streamPostedBuffer bounds the frames forwarded to a stream that it has not handled yet
+const streamPostedBuffer = 16
+
+// StreamRegistry finds the client behind an SSE stream for the frames posted
+// alongside it. Stream ids start with the instance holding the stream, frames
+// posted to another instance are forwarded to it through the broker.
+type StreamRegistry struct {
+	instance string
+	mutex    sync.RWMutex
+	streams  map[string]*stream
+}
+
+type stream struct {
+	client *Client
+	// posted holds the frames forwarded by other instances until the stream handles them
+	posted chan *Frame
+}
+
+func NewStreamRegistry(instance string) *StreamRegistry {
+	return &StreamRegistry{instance: instance, streams: make(map[string]*stream)}
+}
+
+// Add registers the client and returns the id of its stream with the frames
+// forwarded to it
+func (s *StreamRegistry) Add(client *Client) (string, <-chan *Frame) {
+	id := s.instance + "." + uuid.NewString()
+	posted := make(chan *Frame, streamPostedBuffer)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams[id] = &stream{client: client, posted: posted}
+	return id, posted
+}
+
+func (s *StreamRegistry) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.streams, id)
+}
+
+// Local tells whether the stream would be held by this instance
+func (s *StreamRegistry) Local(id string) bool {
+	instance, _, _ := strings.Cut(id, ".")
+	return instance == s.instance
+}
+
+// Lookup returns the client of a stream of this instance, streams of other
+// users are reported as missing too
+func (s *StreamRegistry) Lookup(id, tenant, username string) (*Client, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stream, ok := s.streams[id]
+	if !ok || stream.client.username != username || stream.client.tenant != tenant {
+		return nil, false
+	}
+	return stream.client, true
+}
+
+// post queues a frame forwarded by another instance. Frames for missing streams
+// are dropped, a stream that falls behind is asked to send them again.
+func (s *StreamRegistry) post(id, tenant, username string, frame *Frame) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	stream, ok := s.streams[id]
+	if !ok || stream.client.username != username || stream.client.tenant != tenant {
+		return
+	}
+	stream.client.touch()
+	select {
+	case stream.posted <- frame:
+	default:
+		stream.client.Enqueue(NewErrorFrame(frame.Room, ErrorInternal, "too many frames, send it again"))
+	}
+}
+
+// EncodeStreamCursors turns the last sequence number seen per room into an
+// event id, so Last-Event-ID can resume every room of the stream at once
+func EncodeStreamCursors(cursors map[string]uint64) string {
+	data, _ := json.Marshal(cursors)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeStreamCursors(id string) (map[string]uint64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursors map[string]uint64
+	if err = json.Unmarshal(data, &cursors); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursors, nil
+}
+
+type StreamConnected struct {
+	Connection string `json:"connection"`
+}
+
+type StreamClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type eventWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (e *eventWriter) write(event, id string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if event != "" {
+		_, _ = fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	if id != "" {
+		_, _ = fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	_, _ = fmt.Fprintf(&buf, "data: %s\n\n", payload)
+	return e.send(buf.Bytes())
+}
+
+func (e *eventWriter) send(payload []byte) error {
+	_ = e.rc.SetWriteDeadline(time.Now().Add(e.timeout))
+	if _, err := e.w.Write(payload); err != nil {
+		return err
+	}
+	return e.rc.Flush()
+}
+
+// Stream delivers the chat frames as Server-Sent Events for clients that can not
+// open a WebSocket. Frames are sent with PostFrame using the connection id from the
+// connected event. Events with messages carry the cursors of every room the stream
+// received messages in, a reconnect with Last-Event-ID resumes those rooms,
+// rooms without any message yet have to be joined again.
+func (r *ChatRouter) Stream(w http.ResponseWriter, req *http.Request) {
+	var cursors map[string]uint64
+	if lastEventId := req.Header.Get(HeaderLastEventId); lastEventId != "" {
+		var err error
+		if cursors, err = DecodeStreamCursors(lastEventId); err != nil {
+			WriteString(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	username, expiresAt, ok := r.connectingUser(w, req)
+	if !ok {
+		return
+	}
+	config := r.hub.config
+	client := NewClient(r.hub, nil, username, GetTenant(req), expiresAt, r.validator, r.logger)
+	connection, posted := r.hub.streams.Add(client)
+	metricConnections.Add(1)
+	r.hub.Register(client)
+	defer func() {
+		client.authTimer.Stop()
+		if client.idleTimer != nil {
+			client.idleTimer.Stop()
+		}
+		r.hub.Unregister(client)
+		r.hub.streams.Remove(connection)
+		metricConnections.Add(-1)
+		metricConnectionsClosed.Add(1)
+	}()
+	w.Header().Set(HeaderContentType, ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps reverse proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	events := &eventWriter{w: w, rc: http.NewResponseController(w), timeout: config.WsWriteTimeout}
+	if err := events.write(EventConnected, "", &StreamConnected{Connection: connection}); err != nil {
+		client.writeFailed(err)
+		return
+	}
+	if len(cursors) > 0 {
+		r.hub.HandleFrame(client, &Frame{Type: FrameResume, Cursors: cursors})
+	} else {
+		cursors = make(map[string]uint64)
+	}
+	ticker := time.NewTicker(config.WsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case frame, ok := <-client.send:
+			if !ok {
+				client.mutex.Lock()
+				closed := &StreamClose{Code: client.closeCode, Reason: client.closeReason}
+				client.mutex.Unlock()
+				if closed.Code != 0 {
+					_ = events.write(EventClose, "", closed)
+				}
+				return
+			}
+			id := ""
+			if (frame.Type == FrameMessage || frame.Type == FrameResume) && frame.Seq > cursors[frame.Room] {
+				cursors[frame.Room] = frame.Seq
+				id = EncodeStreamCursors(cursors)
+			}
+			if err := events.write("", id, frame); err != nil {
+				client.writeFailed(err)
+				return
+			}
+		case frame := <-posted:
+			r.hub.HandleFrame(client, frame)
+		case <-ticker.C:
+			// Comments keep proxies from timing out a quiet stream
+			if err := events.send([]byte(": ping\n\n")); err != nil {
+				client.writeFailed(err)
+				return
+			}
+		}
+	}
+}
+
+// PostFrame hands a frame to the hub on behalf of the SSE stream named by the
+// X-Chat-Connection header, errors are delivered on the stream like on a WebSocket.
+// Frames for streams of other instances are forwarded to them, those instances
+// drop the frames of streams that are missing or belong to another user.
+func (r *ChatRouter) PostFrame(w http.ResponseWriter, req *http.Request) {
+	username, err := GetTokenUsername(GetParsedToken(req))
+	if err != nil {
+		r.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tenant := GetTenant(req)
+	connection := req.Header.Get(HeaderChatConnection)
+	client, found := r.hub.streams.Lookup(connection, tenant, username)
+	if !found && r.hub.streams.Local(connection) {
+		WriteString(w, "unknown connection", http.StatusNotFound)
+		return
+	}
+	var frame Frame
+	if err = ReadJSON(w, req, &frame); err != nil {
+		WriteString(w, "malformed frame", http.StatusBadRequest)
+		return
+	}
+	// Every request is authenticated, the stream is closed once its own token expires
+	if frame.Type == FrameAuth {
+		WriteString(w, "auth frames are not supported on streams", http.StatusBadRequest)
+		return
+	}
+	if found {
+		client.touch()
+	}
+	if ok, wait := r.hub.Throttle(tenant, username, &frame); !ok {
+		w.Header().Set(HeaderRetryAfter, strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+		WriteJSON(w, NewRateLimitedFrame(frame.Room, wait), http.StatusTooManyRequests)
+		return
+	}
+	if found {
+		r.hub.HandleFrame(client, &frame)
+	} else {
+		r.hub.ForwardToStream(connection, tenant, username, &frame)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
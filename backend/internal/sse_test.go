@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	headerTestUser   = "X-Test-User"
+	headerTestTenant = "X-Test-Tenant"
+)
+
+// streamServer serves the SSE endpoints of the hub. Requests name their user in
+// test headers instead of carrying a token.
+func (h *testHub) streamServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	router := &ChatRouter{hub: h.Hub, logger: h.logger}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		claims := jwt.MapClaims{
+			CognitoUsernameClaim: req.Header.Get(headerTestUser),
+			"exp":                float64(time.Now().Add(time.Hour).Unix()),
+		}
+		tenant := req.Header.Get(headerTestTenant)
+		if tenant == "" {
+			tenant = DefaultTenant
+		}
+		req = req.WithContext(WithParsedToken(req.Context(), &jwt.Token{Claims: claims, Valid: true}, tenant))
+		if req.Method == http.MethodPost {
+			router.PostFrame(w, req)
+		} else {
+			router.Stream(w, req)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+type streamEvent struct {
+	event string
+	id    string
+	data  string
+}
+
+type eventStream struct {
+	reader *bufio.Reader
+}
+
+func openStream(t *testing.T, server *httptest.Server, username, lastEventId string) *eventStream {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerTestUser, username)
+	if lastEventId != "" {
+		req.Header.Set(HeaderLastEventId, lastEventId)
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ignore(resp.Body.Close) })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream answered with %d", resp.StatusCode)
+	}
+	return &eventStream{reader: bufio.NewReader(resp.Body)}
+}
+
+// next reads the next event, ok is false once the stream has ended
+func (s *eventStream) next(t *testing.T) (streamEvent, bool) {
+	t.Helper()
+	var event streamEvent
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return event, false
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.data != "":
+			return event, true
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// connection reads the connected event the stream opens with
+func (s *eventStream) connection(t *testing.T) string {
+	t.Helper()
+	event, ok := s.next(t)
+	if !ok || event.event != EventConnected {
+		t.Fatalf("stream opened with %+v", event)
+	}
+	var connected StreamConnected
+	if err := json.Unmarshal([]byte(event.data), &connected); err != nil {
+		t.Fatal(err)
+	}
+	return connected.Connection
+}
+
+func TestStreamResumesFromLastEventId(t *testing.T) {
+	hub := newTestHub(t)
+	hub.createRoom(t, testRoom, "alice")
+	hub.appendMessages(t, testRoom, 3)
+	server := hub.streamServer(t)
+
+	stream := openStream(t, server, "alice", EncodeStreamCursors(map[string]uint64{testRoom: 1}))
+	stream.connection(t)
+	var seqs []uint64
+	var lastId string
+	for {
+		event, ok := stream.next(t)
+		if !ok {
+			t.Fatal("stream ended during the resume")
+		}
+		var frame Frame
+		if err := json.Unmarshal([]byte(event.data), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == FrameMessage {
+			seqs = append(seqs, frame.Seq)
+		}
+		if event.id != "" {
+			lastId = event.id
+		}
+		if frame.Type == FrameResume {
+			break
+		}
+	}
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Errorf("resumed with messages %v, want [2 3]", seqs)
+	}
+	cursors, err := DecodeStreamCursors(lastId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursors[testRoom] != 3 {
+		t.Errorf("last event id resumes from %d, want 3", cursors[testRoom])
+	}
+}
+
+func TestStreamRejectsInvalidLastEventId(t *testing.T) {
+	server := newTestHub(t).streamServer(t)
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerTestUser, "alice")
+	req.Header.Set(HeaderLastEventId, "not base64!")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignore(resp.Body.Close)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("answered with %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// postFrame posts the frame for the connection and returns the status it was answered with
+func postFrame(t *testing.T, server *httptest.Server, tenant, username, connection, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(headerTestUser, username)
+	req.Header.Set(headerTestTenant, tenant)
+	req.Header.Set(HeaderChatConnection, connection)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignore(resp.Body.Close)
+	return resp.StatusCode
+}
+
+func TestPostFrame(t *testing.T) {
+	hub := newTestHub(t)
+	hub.createRoom(t, testRoom, "alice", "bob")
+	server := hub.streamServer(t)
+	connection := openStream(t, server, "alice", "").connection(t)
+
+	tests := []struct {
+		name       string
+		tenant     string
+		username   string
+		connection string
+		status     int
+	}{
+		{name: "own stream", username: "alice", connection: connection, status: http.StatusAccepted},
+		{name: "unknown stream", username: "alice", connection: hub.instance + ".missing", status: http.StatusNotFound},
+		{name: "stream of another user", username: "bob", connection: connection, status: http.StatusNotFound},
+		{name: "same user of another tenant", tenant: "acme", username: "alice", connection: connection, status: http.StatusNotFound},
+		// Streams of other instances are only looked up once the frame reaches them
+		{name: "stream of another instance", username: "alice", connection: "other.missing", status: http.StatusAccepted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"type":"join","room":"` + testRoom + `"}`
+			if status := postFrame(t, server, test.tenant, test.username, test.connection, body); status != test.status {
+				t.Errorf("answered with %d, want %d", status, test.status)
+			}
+		})
+	}
+}
+
+func TestPostFrameReachesStreamOfAnotherInstance(t *testing.T) {
+	config := &Config{}
+	config.SetDefaults()
+	config.MessageStore = MessageStoreRedis
+	config.Broker = BrokerRedis
+	config.RedisUrl = startRedis(t)
+	servers := make([]*httptest.Server, 2)
+	var hub *testHub
+	for i := range servers {
+		broker, err := NewRedisBroker(context.Background(), config.RedisUrl, config.RedisChannel, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ignore(broker.Close) })
+		hub = newConfiguredHub(t, config, broker)
+		servers[i] = hub.streamServer(t)
+	}
+	hub.createRoom(t, testRoom, "alice", "bob")
+	stream := openStream(t, servers[0], "alice", "")
+	connection := stream.connection(t)
+
+	// The second instance can not tell whose stream it is, the first one drops the frames of bob
+	frames := []struct {
+		username string
+		body     string
+	}{
+		{username: "bob", body: `{"type":"join","room":"` + testRoom + `"}`},
+		{username: "bob", body: `{"type":"message","room":"` + testRoom + `","body":"not alice"}`},
+		{username: "alice", body: `{"type":"join","room":"` + testRoom + `"}`},
+		{username: "alice", body: `{"type":"message","room":"` + testRoom + `","body":"hello"}`},
+	}
+	for _, frame := range frames {
+		if status := postFrame(t, servers[1], "", frame.username, connection, frame.body); status != http.StatusAccepted {
+			t.Fatalf("answered with %d, want %d", status, http.StatusAccepted)
+		}
+	}
+	for {
+		event, ok := stream.next(t)
+		if !ok {
+			t.Fatal("stream ended before the message")
+		}
+		var frame Frame
+		if err := json.Unmarshal([]byte(event.data), &frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != FrameMessage {
+			continue
+		}
+		if frame.Sender != "alice" || frame.Body != "hello" {
+			t.Errorf("stream got the message %+v, want the one of alice", frame)
+		}
+		break
+	}
+}
+
+func TestStreamClosesOnDrain(t *testing.T) {
+	hub := newTestHub(t)
+	stream := openStream(t, hub.streamServer(t), "alice", "")
+	stream.connection(t)
+	hub.Drain()
+	for {
+		event, ok := stream.next(t)
+		if !ok {
+			t.Fatal("stream ended without a close event")
+		}
+		if event.event != EventClose {
+			continue
+		}
+		var closed StreamClose
+		if err := json.Unmarshal([]byte(event.data), &closed); err != nil {
+			t.Fatal(err)
+		}
+		if closed.Code != websocket.CloseGoingAway {
+			t.Errorf("closed with %d, want %d", closed.Code, websocket.CloseGoingAway)
+		}
+		break
+	}
+	if event, ok := stream.next(t); ok {
+		t.Errorf("stream goes on with %+v after closing", event)
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+const (
+	MessageStoreMemory = "memory"
+	MessageStoreDisk   = "disk"
+	MessageStoreRedis  = "redis"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+type HistoryQuery struct {
+	// Before is an exclusive upper bound on the sequence number, zero means the latest message
+	Before uint64
+	Limit  int
+	// Thread selects the replies to the message with this id,
+	// without it only the top-level messages of the room are returned
+	Thread string
+}
+
+// page walks back from the upper bound of the query down to the exclusive
+// lower bound and returns up to query.Limit matching sequence numbers in ascending order
+func page(last, after uint64, query HistoryQuery, match func(seq uint64) bool) []uint64 {
+	end := last
+	if query.Before != 0 && query.Before-1 < end {
+		end = query.Before - 1
+	}
+	var seqs []uint64
+	for seq := end; seq > after && len(seqs) < query.Limit; seq-- {
+		if match(seq) {
+			seqs = append(seqs, seq)
+		}
+	}
+	slices.Reverse(seqs)
+	return seqs
+}
+
+// MessageStore keeps chat messages per room. Append assigns the message
+// the next sequence number of its room, History returns a page of messages
+// in ascending sequence order.
+type MessageStore interface {
+	Append(ctx context.Context, message *Message) error
+	Get(ctx context.Context, room, id string) (*Message, error)
+	// Update applies fn to a copy of the message and stores it unless fn fails
+	Update(ctx context.Context, room, id string, fn func(message *Message) error) (*Message, error)
+	History(ctx context.Context, room string, query HistoryQuery) ([]*Message, error)
+	// Since returns up to limit messages after the sequence number, thread replies included
+	Since(ctx context.Context, room string, after uint64, limit int) ([]*Message, error)
+	LastSeq(ctx context.Context, room string) (uint64, error)
+	Close() error
+}
+
+func NewMessageStore(config *Config) (MessageStore, error) {
+	switch config.MessageStore {
+	case MessageStoreDisk:
+		return NewDiskMessageStore(config.MessageStoreDir,
+			config.MessageStoreSegmentSize,
+			config.MessageStoreSync == MessageStoreSyncAlways)
+	case MessageStoreRedis:
+		return NewRedisMessageStore(config.RedisUrl)
+	default:
+		return NewMemoryMessageStore(), nil
+	}
+}
+
+type MemoryMessageStore struct {
+	mutex sync.RWMutex
+	rooms map[string][]*Message
+	// ids maps message ids to sequence numbers within their room
+	ids map[string]uint64
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{
+		rooms: make(map[string][]*Message),
+		ids:   make(map[string]uint64),
+	}
+}
+
+func (s *MemoryMessageStore) Append(_ context.Context, message *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if message.ParentId != "" {
+		if _, ok := s.find(message.Room, message.ParentId); !ok {
+			return ErrMessageNotFound
+		}
+	}
+	messages := s.rooms[message.Room]
+	message.Seq = uint64(len(messages)) + 1
+	s.rooms[message.Room] = append(messages, message.clone())
+	s.ids[message.Id] = message.Seq
+	return nil
+}
+
+// find must be called with the mutex held
+func (s *MemoryMessageStore) find(room, id string) (*Message, bool) {
+	seq, ok := s.ids[id]
+	messages := s.rooms[room]
+	if !ok || seq > uint64(len(messages)) || messages[seq-1].Id != id {
+		return nil, false
+	}
+	return messages[seq-1], true
+}
+
+func (s *MemoryMessageStore) Get(_ context.Context, room, id string) (*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	message, ok := s.find(room, id)
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return message.clone(), nil
+}
+
+func (s *MemoryMessageStore) Update(
+	_ context.Context,
+	room, id string,
+	fn func(message *Message) error,
+) (*Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.find(room, id)
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	updated := current.clone()
+	if err := fn(updated); err != nil {
+		return nil, err
+	}
+	s.rooms[room][current.Seq-1] = updated
+	return updated.clone(), nil
+}
+
+func (s *MemoryMessageStore) History(
+	_ context.Context,
+	room string,
+	query HistoryQuery,
+) ([]*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	messages := s.rooms[room]
+	var after uint64
+	if query.Thread != "" {
+		parent, ok := s.find(room, query.Thread)
+		if !ok {
+			return nil, ErrMessageNotFound
+		}
+		after = parent.Seq
+	}
+	seqs := page(uint64(len(messages)), after, query, func(seq uint64) bool {
+		return messages[seq-1].ParentId == query.Thread
+	})
+	result := make([]*Message, 0, len(seqs))
+	for _, seq := range seqs {
+		result = append(result, messages[seq-1].clone())
+	}
+	return result, nil
+}
+
+func (s *MemoryMessageStore) Since(
+	_ context.Context,
+	room string,
+	after uint64,
+	limit int,
+) ([]*Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	messages := s.rooms[room]
+	start := min(after, uint64(len(messages)))
+	end := min(start+uint64(limit), uint64(len(messages)))
+	result := make([]*Message, 0, end-start)
+	for _, message := range messages[start:end] {
+		result = append(result, message.clone())
+	}
+	return result, nil
+}
+
+func (s *MemoryMessageStore) LastSeq(_ context.Context, room string) (uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return uint64(len(s.rooms[room])), nil
+}
+
+func (s *MemoryMessageStore) Close() error {
+	return nil
+}
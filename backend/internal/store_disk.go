@@ -0,0 +1,669 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Every room is a directory of append-only segments. A segment is a pair of files:
+//   - <base>.log holds records: uint32 payload length, uint32 crc32 of the payload, JSON payload
+//   - <base>.idx holds fixed size entries: uint64 seq, uint64 record offset, uint32 length, 16 byte id,
+//     uint64 seq of the thread parent or zero for a top-level message
+//
+// <base> numbers the segments of a room in the order they were created, rewrites
+// land in the newest segment. Rewriting a message appends a new record with the same
+// sequence number, the last record for a sequence number wins. Superseded records are
+// never reclaimed, every edit or reaction grows the room by a full copy of the message.
+//
+// Only the newest segment keeps its files open, sealed segments are opened for the
+// duration of a read. With MessageStoreSyncAlways a write is fsynced before it is
+// acknowledged. With MessageStoreSyncNone a crash of the machine loses the writes the
+// OS had not flushed yet, a segment is only fsynced once it is sealed.
+const (
+	segmentLogExtension   = ".log"
+	segmentIndexExtension = ".idx"
+	recordHeaderSize      = 8
+	indexEntrySize        = 44
+)
+
+const (
+	MessageStoreSyncAlways = "always"
+	MessageStoreSyncNone   = "none"
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt record")
+	// errTornRecord is a record that runs past the end of its segment
+	errTornRecord = errors.New("torn record")
+)
+
+type segment struct {
+	base uint64
+	// log and index are nil once the segment is sealed
+	log       *os.File
+	index     *os.File
+	size      int64
+	indexSize int64
+}
+
+type recordLocation struct {
+	segment *segment
+	offset  int64
+	length  uint32
+}
+
+type roomLog struct {
+	mutex       sync.RWMutex
+	dir         string
+	segmentSize int64
+	sync        bool
+	// err fails every write once a failed write could not be rolled back
+	err      error
+	segments []*segment
+	// locations[seq-1] points at the latest record of a message
+	locations []recordLocation
+	// parents[seq-1] is the sequence number of the thread parent
+	parents []uint64
+	ids     map[string]uint64
+}
+
+type DiskMessageStore struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+	mutex       sync.Mutex
+	rooms       map[string]*roomLog
+}
+
+// NewDiskMessageStore keeps the rooms under dir, with sync every write is
+// fsynced before it is acknowledged
+func NewDiskMessageStore(dir string, segmentSize int64, sync bool) (*DiskMessageStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &DiskMessageStore{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+		rooms:       make(map[string]*roomLog),
+	}, nil
+}
+
+func (s *DiskMessageStore) room(name string) (*roomLog, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if log, ok := s.rooms[name]; ok {
+		return log, nil
+	}
+	// Room ids come from clients, hex keeps them from escaping the store directory
+	dir := filepath.Join(s.dir, hex.EncodeToString([]byte(name)))
+	log, err := openRoomLog(dir, s.segmentSize, s.sync)
+	if err != nil {
+		return nil, err
+	}
+	s.rooms[name] = log
+	return log, nil
+}
+
+func (s *DiskMessageStore) Append(_ context.Context, message *Message) error {
+	log, err := s.room(message.Room)
+	if err != nil {
+		return err
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	message.Seq = uint64(len(log.locations)) + 1
+	return log.write(message)
+}
+
+func (s *DiskMessageStore) Get(_ context.Context, room, id string) (*Message, error) {
+	log, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+	seq, ok := log.ids[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	reader := log.reader()
+	defer reader.close()
+	return reader.read(seq)
+}
+
+func (s *DiskMessageStore) Update(
+	_ context.Context,
+	room, id string,
+	fn func(message *Message) error,
+) (*Message, error) {
+	log, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	seq, ok := log.ids[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	reader := log.reader()
+	message, err := reader.read(seq)
+	reader.close()
+	if err != nil {
+		return nil, err
+	}
+	if err = fn(message); err != nil {
+		return nil, err
+	}
+	// The id and sequence number are what the index is keyed on
+	message.Id = id
+	message.Seq = seq
+	if err = log.write(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (s *DiskMessageStore) History(
+	_ context.Context,
+	room string,
+	query HistoryQuery,
+) ([]*Message, error) {
+	log, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+	var parent uint64
+	if query.Thread != "" {
+		var ok bool
+		if parent, ok = log.ids[query.Thread]; !ok {
+			return nil, ErrMessageNotFound
+		}
+	}
+	seqs := page(uint64(len(log.locations)), parent, query, func(seq uint64) bool {
+		return log.parents[seq-1] == parent
+	})
+	reader := log.reader()
+	defer reader.close()
+	result := make([]*Message, 0, len(seqs))
+	for _, seq := range seqs {
+		message, err := reader.read(seq)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+func (s *DiskMessageStore) Since(
+	_ context.Context,
+	room string,
+	after uint64,
+	limit int,
+) ([]*Message, error) {
+	log, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+	last := uint64(len(log.locations))
+	end := min(after+uint64(limit), last)
+	reader := log.reader()
+	defer reader.close()
+	var result []*Message
+	for seq := after + 1; seq <= end; seq++ {
+		message, err := reader.read(seq)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+func (s *DiskMessageStore) LastSeq(_ context.Context, room string) (uint64, error) {
+	log, err := s.room(room)
+	if err != nil {
+		return 0, err
+	}
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+	return uint64(len(log.locations)), nil
+}
+
+func (s *DiskMessageStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var errs []error
+	for _, log := range s.rooms {
+		errs = append(errs, log.close())
+	}
+	s.rooms = make(map[string]*roomLog)
+	return errors.Join(errs...)
+}
+
+func openRoomLog(dir string, segmentSize int64, sync bool) (*roomLog, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bases []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentLogExtension)
+		if !ok {
+			continue
+		}
+		base, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	slices.Sort(bases)
+	log := &roomLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+		ids:         make(map[string]uint64),
+	}
+	for i, base := range bases {
+		seg, err := openSegment(dir, base)
+		if err != nil {
+			_ = log.close()
+			return nil, err
+		}
+		log.segments = append(log.segments, seg)
+		newest := i == len(bases)-1
+		if err = log.loadIndex(seg, newest); err != nil {
+			_ = log.close()
+			return nil, fmt.Errorf("segment %d of %s: %w", base, dir, err)
+		}
+		if !newest {
+			if err = seg.seal(); err != nil {
+				_ = log.close()
+				return nil, err
+			}
+		}
+	}
+	return log, nil
+}
+
+func segmentPath(dir string, base uint64, extension string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", base, extension))
+}
+
+func openSegment(dir string, base uint64) (*segment, error) {
+	logFile, err := os.OpenFile(segmentPath(dir, base, segmentLogExtension), os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(segmentPath(dir, base, segmentIndexExtension), os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		ignore(logFile.Close)
+		return nil, err
+	}
+	seg := &segment{base: base, log: logFile, index: indexFile}
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	indexInfo, err := indexFile.Stat()
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	seg.size = logInfo.Size()
+	seg.indexSize = indexInfo.Size()
+	return seg, nil
+}
+
+func (s *segment) close() {
+	ignore(s.log.Close)
+	ignore(s.index.Close)
+}
+
+// seal flushes and closes the files of a segment that is no longer written to
+func (s *segment) seal() error {
+	if s.log == nil {
+		return nil
+	}
+	err := errors.Join(s.log.Sync(), s.index.Sync())
+	s.close()
+	s.log, s.index = nil, nil
+	return err
+}
+
+type indexEntry struct {
+	seq    uint64
+	offset int64
+	length uint32
+	id     uuid.UUID
+	parent uint64
+}
+
+func (e *indexEntry) encode() []byte {
+	buf := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(buf[0:], e.seq)
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.offset))
+	binary.BigEndian.PutUint32(buf[16:], e.length)
+	copy(buf[20:], e.id[:])
+	binary.BigEndian.PutUint64(buf[36:], e.parent)
+	return buf
+}
+
+func decodeIndexEntry(buf []byte) indexEntry {
+	entry := indexEntry{
+		seq:    binary.BigEndian.Uint64(buf[0:]),
+		offset: int64(binary.BigEndian.Uint64(buf[8:])),
+		length: binary.BigEndian.Uint32(buf[16:]),
+	}
+	copy(entry.id[:], buf[20:36])
+	entry.parent = binary.BigEndian.Uint64(buf[36:])
+	return entry
+}
+
+// loadIndex trusts the index only when it covers the log exactly, otherwise
+// (e.g. after a crash between the two writes) it is rebuilt from the log.
+func (l *roomLog) loadIndex(seg *segment, newest bool) error {
+	data := make([]byte, seg.indexSize-seg.indexSize%indexEntrySize)
+	if _, err := seg.index.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	var entries []indexEntry
+	for offset := 0; offset < len(data); offset += indexEntrySize {
+		entries = append(entries, decodeIndexEntry(data[offset:offset+indexEntrySize]))
+	}
+	var end int64
+	indexed := int64(-1)
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		end = last.offset + recordHeaderSize + int64(last.length)
+		indexed = last.offset
+	}
+	if seg.indexSize%indexEntrySize != 0 || end != seg.size {
+		var err error
+		if entries, err = l.rebuildIndex(seg, newest, indexed); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		l.track(seg, entry)
+	}
+	return nil
+}
+
+// rebuildIndex reads every record of the segment. Only the last write to the
+// newest segment can have been cut short by a crash, such a torn tail is dropped
+// while any other damage keeps the room from opening. A record the old index
+// already had an entry after was written completely, indexed is the offset
+// of the last entry or -1.
+func (l *roomLog) rebuildIndex(seg *segment, newest bool, indexed int64) ([]indexEntry, error) {
+	var entries []indexEntry
+	// Parents may be earlier in the same segment, which is not tracked yet
+	ids := make(map[string]uint64)
+	var offset int64
+	for offset < seg.size {
+		message, length, err := readRecord(seg.log, offset, seg.size)
+		if err != nil {
+			torn, tornErr := isTornTail(seg, offset, err)
+			if tornErr != nil {
+				return nil, tornErr
+			}
+			if !torn || !newest || offset < indexed {
+				return nil, fmt.Errorf("record at %d: %w", offset, err)
+			}
+			if err = seg.log.Truncate(offset); err != nil {
+				return nil, err
+			}
+			seg.size = offset
+			break
+		}
+		id, err := uuid.Parse(message.Id)
+		if err != nil {
+			return nil, fmt.Errorf("record at %d: %w: %w", offset, errCorruptRecord, err)
+		}
+		parent, ok := ids[message.ParentId]
+		if !ok {
+			parent = l.ids[message.ParentId]
+		}
+		ids[message.Id] = message.Seq
+		entries = append(entries, indexEntry{
+			seq:    message.Seq,
+			offset: offset,
+			length: length,
+			id:     id,
+			parent: parent,
+		})
+		offset += recordHeaderSize + int64(length)
+	}
+	data := make([]byte, 0, len(entries)*indexEntrySize)
+	for _, entry := range entries {
+		data = append(data, entry.encode()...)
+	}
+	if err := seg.index.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := seg.index.WriteAt(data, 0); err != nil {
+		return nil, err
+	}
+	seg.indexSize = int64(len(data))
+	return entries, nil
+}
+
+// isTornTail tells a record cut short by a crash apart from a damaged one. Besides
+// a short header or payload a crash can leave zeros behind, when the size of the
+// file reached the disk but its data did not.
+func isTornTail(seg *segment, offset int64, err error) (bool, error) {
+	if errors.Is(err, errTornRecord) {
+		return true, nil
+	}
+	if !errors.Is(err, errCorruptRecord) {
+		return false, err
+	}
+	tail := make([]byte, seg.size-offset)
+	if _, err = seg.log.ReadAt(tail, offset); err != nil {
+		return false, err
+	}
+	return !slices.ContainsFunc(tail, func(b byte) bool { return b != 0 }), nil
+}
+
+func (l *roomLog) track(seg *segment, entry indexEntry) {
+	location := recordLocation{segment: seg, offset: entry.offset, length: entry.length}
+	if entry.seq > uint64(len(l.locations)) {
+		missing := entry.seq - uint64(len(l.locations))
+		l.locations = append(l.locations, make([]recordLocation, missing)...)
+		l.parents = append(l.parents, make([]uint64, missing)...)
+	}
+	l.locations[entry.seq-1] = location
+	l.parents[entry.seq-1] = entry.parent
+	l.ids[entry.id.String()] = entry.seq
+}
+
+func (l *roomLog) write(message *Message) error {
+	if l.err != nil {
+		return l.err
+	}
+	id, err := uuid.Parse(message.Id)
+	if err != nil {
+		return err
+	}
+	var parent uint64
+	if message.ParentId != "" {
+		var ok bool
+		if parent, ok = l.ids[message.ParentId]; !ok {
+			return ErrMessageNotFound
+		}
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	seg, err := l.activeSegment()
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	entry := indexEntry{
+		seq:    message.Seq,
+		offset: seg.size,
+		length: uint32(len(payload)),
+		id:     id,
+		parent: parent,
+	}
+	if _, err = seg.log.WriteAt(record, seg.size); err != nil {
+		return l.rollback(seg, err)
+	}
+	// Without its index entry the record would still turn up once the index is rebuilt
+	if _, err = seg.index.WriteAt(entry.encode(), seg.indexSize); err != nil {
+		return l.rollback(seg, err)
+	}
+	if l.sync {
+		if err = errors.Join(seg.log.Sync(), seg.index.Sync()); err != nil {
+			return l.rollback(seg, err)
+		}
+	}
+	seg.size += int64(len(record))
+	seg.indexSize += indexEntrySize
+	l.track(seg, entry)
+	return nil
+}
+
+// rollback cuts a failed write off the segment. When that fails as well the
+// files no longer match what is tracked and the room takes no more writes.
+func (l *roomLog) rollback(seg *segment, err error) error {
+	rollbackErr := errors.Join(seg.log.Truncate(seg.size), seg.index.Truncate(seg.indexSize))
+	if rollbackErr != nil {
+		l.err = fmt.Errorf("room %s takes no writes after a failed rollback: %w", l.dir, rollbackErr)
+		return errors.Join(err, l.err)
+	}
+	return err
+}
+
+// activeSegment returns the newest segment, or a new one when it is full. Segments are
+// loaded in the order of their bases, so a new base has to follow every existing one.
+func (l *roomLog) activeSegment() (*segment, error) {
+	base := uint64(1)
+	if len(l.segments) > 0 {
+		last := l.segments[len(l.segments)-1]
+		if last.size < l.segmentSize {
+			return last, nil
+		}
+		if err := last.seal(); err != nil {
+			return nil, err
+		}
+		base = last.base + 1
+	}
+	seg, err := openSegment(l.dir, base)
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, seg)
+	return seg, nil
+}
+
+// logReader reads the records of a room with its lock held. Sealed segments
+// are opened on the first read from them and stay open until close.
+type logReader struct {
+	log    *roomLog
+	sealed map[uint64]*os.File
+}
+
+func (l *roomLog) reader() *logReader {
+	return &logReader{log: l, sealed: make(map[uint64]*os.File)}
+}
+
+func (r *logReader) read(seq uint64) (*Message, error) {
+	if seq == 0 || seq > uint64(len(r.log.locations)) {
+		return nil, ErrMessageNotFound
+	}
+	location := r.log.locations[seq-1]
+	seg := location.segment
+	if seg == nil {
+		return nil, ErrMessageNotFound
+	}
+	file := seg.log
+	if file == nil {
+		var ok bool
+		if file, ok = r.sealed[seg.base]; !ok {
+			var err error
+			file, err = os.Open(segmentPath(r.log.dir, seg.base, segmentLogExtension))
+			if err != nil {
+				return nil, err
+			}
+			r.sealed[seg.base] = file
+		}
+	}
+	message, _, err := readRecord(file, location.offset, seg.size)
+	return message, err
+}
+
+func (r *logReader) close() {
+	for _, file := range r.sealed {
+		ignore(file.Close)
+	}
+}
+
+// readRecord reads the record at the offset of a log of the size
+func readRecord(file *os.File, offset, size int64) (*Message, uint32, error) {
+	if size-offset < recordHeaderSize {
+		return nil, 0, errTornRecord
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	// Checked before the length sizes the payload, a damaged header could ask for gigabytes
+	if int64(length) > size-offset-recordHeaderSize {
+		return nil, 0, errTornRecord
+	}
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+	var message Message
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", errCorruptRecord, err)
+	}
+	return &message, length, nil
+}
+
+func (l *roomLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var errs []error
+	for _, seg := range l.segments {
+		errs = append(errs, seg.seal())
+	}
+	l.segments = nil
+	return errors.Join(errs...)
+}
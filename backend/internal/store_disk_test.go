@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const testRoom = "general"
+
+func newTestMessage(body string) *Message {
+	return &Message{
+		Id:        uuid.NewString(),
+		Room:      testRoom,
+		Sender:    "alice",
+		Body:      body,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+func openTestStore(t *testing.T, dir string) *DiskMessageStore {
+	t.Helper()
+	// Small segments so every test fills a few of them
+	store, err := NewDiskMessageStore(dir, 512, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func appendTestMessages(t *testing.T, store MessageStore, count int) []*Message {
+	t.Helper()
+	messages := make([]*Message, count)
+	for i := range messages {
+		messages[i] = newTestMessage("message")
+		if err := store.Append(context.Background(), messages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return messages
+}
+
+func TestDiskMessageStoreRewritesSurviveReopen(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(t *testing.T, store MessageStore, message *Message)
+		check  func(t *testing.T, message *Message)
+	}{
+		{
+			name: "edit",
+			update: func(t *testing.T, store MessageStore, message *Message) {
+				for i := range 30 {
+					body := "edit " + string(rune('a'+i%26))
+					_, err := store.Update(context.Background(), testRoom, message.Id, func(m *Message) error {
+						m.Edit(body, time.Now().UTC())
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			},
+			check: func(t *testing.T, message *Message) {
+				if message.Body != "edit d" || len(message.Revisions) != 30 {
+					t.Errorf("body %q with %d revisions, want the last edit with 30", message.Body, len(message.Revisions))
+				}
+			},
+		},
+		{
+			name: "delete after edits",
+			update: func(t *testing.T, store MessageStore, message *Message) {
+				for range 30 {
+					_, err := store.Update(context.Background(), testRoom, message.Id, func(m *Message) error {
+						m.Edit("edited", time.Now().UTC())
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err := store.Update(context.Background(), testRoom, message.Id, func(m *Message) error {
+					m.Delete("alice", time.Now().UTC())
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, message *Message) {
+				if !message.Deleted || message.Body != "" {
+					t.Errorf("deleted %v with body %q, want a tombstone", message.Deleted, message.Body)
+				}
+			},
+		},
+		{
+			name: "reactions",
+			update: func(t *testing.T, store MessageStore, message *Message) {
+				for _, user := range []string{"bob", "carol", "dave", "erin", "frank", "grace"} {
+					_, err := store.Update(context.Background(), testRoom, message.Id, func(m *Message) error {
+						return m.React(user, ":tada:")
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				_, err := store.Update(context.Background(), testRoom, message.Id, func(m *Message) error {
+					return m.Unreact("bob", ":tada:")
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, message *Message) {
+				if len(message.Reactions) != 1 || message.Reactions[0].Count != 5 {
+					t.Errorf("reactions %+v, want :tada: from 5 users", message.Reactions)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestStore(t, dir)
+			messages := appendTestMessages(t, store, 10)
+			target := messages[2]
+			test.update(t, store, target)
+			// Messages appended after the rewrites go to later segments
+			appendTestMessages(t, store, 5)
+			before, err := store.Get(context.Background(), testRoom, target.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, before)
+			if err = store.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			store = openTestStore(t, dir)
+			defer ignore(store.Close)
+			after, err := store.Get(context.Background(), testRoom, target.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, after)
+			if after.Seq != target.Seq {
+				t.Errorf("seq %d after reopening, want %d", after.Seq, target.Seq)
+			}
+			last, err := store.LastSeq(context.Background(), testRoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != 15 {
+				t.Errorf("last seq %d after reopening, want 15", last)
+			}
+		})
+	}
+}
+
+func TestDiskMessageStoreSegmentsStayBounded(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+	defer ignore(store.Close)
+	messages := appendTestMessages(t, store, 3)
+	// Reactions keep the record size the same, unlike edits
+	for i := range 200 {
+		_, err := store.Update(context.Background(), testRoom, messages[0].Id, func(m *Message) error {
+			if i%2 == 0 {
+				return m.React("bob", ":tada:")
+			}
+			return m.Unreact("bob", ":tada:")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	log, err := store.room(testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(log.dir, "*"+segmentLogExtension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(log.segments) {
+		t.Errorf("%d open segments for %d files", len(log.segments), len(files))
+	}
+	for _, seg := range log.segments[:len(log.segments)-1] {
+		if seg.log != nil || seg.index != nil {
+			t.Errorf("sealed segment %d keeps its files open", seg.base)
+		}
+		info, err := os.Stat(segmentPath(log.dir, seg.base, segmentLogExtension))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A segment is only written to while it is below the size
+		if info.Size() > 2*512 {
+			t.Errorf("segment %d grew to %d bytes", seg.base, info.Size())
+		}
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignore(file.Close)
+	if _, err = file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskMessageStoreRecoversTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage is given the files of the newest segment
+		damage func(t *testing.T, log, index string)
+		last   uint64
+	}{
+		{
+			name: "half a header",
+			damage: func(t *testing.T, log, _ string) {
+				appendFile(t, log, []byte{0, 0, 0})
+			},
+			last: 10,
+		},
+		{
+			name: "half a payload",
+			damage: func(t *testing.T, log, _ string) {
+				appendFile(t, log, []byte{0, 0, 0, 100, 1, 2, 3, 4, '{', '"'})
+			},
+			last: 10,
+		},
+		{
+			name: "zeroed tail",
+			damage: func(t *testing.T, log, _ string) {
+				appendFile(t, log, make([]byte, 64))
+			},
+			last: 10,
+		},
+		{
+			name: "torn index entry",
+			damage: func(t *testing.T, _, index string) {
+				appendFile(t, index, make([]byte, indexEntrySize/2))
+			},
+			last: 10,
+		},
+		{
+			// The index entry was written but the record did not reach the disk
+			name: "record lost",
+			damage: func(t *testing.T, log, index string) {
+				data, err := os.ReadFile(index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				last := decodeIndexEntry(data[len(data)-indexEntrySize:])
+				if err = os.Truncate(log, last.offset+recordHeaderSize/2); err != nil {
+					t.Fatal(err)
+				}
+			},
+			last: 9,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestStore(t, dir)
+			appendTestMessages(t, store, 10)
+			room, err := store.room(testRoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newest := room.segments[len(room.segments)-1]
+			log, index := newest.log.Name(), newest.index.Name()
+			if err = store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			test.damage(t, log, index)
+
+			store = openTestStore(t, dir)
+			last, err := store.LastSeq(context.Background(), testRoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != test.last {
+				t.Errorf("last seq %d after recovering, want %d", last, test.last)
+			}
+			// Appends after the recovery must not end up behind the torn tail
+			appended := appendTestMessages(t, store, 1)[0]
+			if err = store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			store = openTestStore(t, dir)
+			defer ignore(store.Close)
+			message, err := store.Get(context.Background(), testRoom, appended.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.Seq != test.last+1 {
+				t.Errorf("seq %d of the message appended after recovering, want %d", message.Seq, test.last+1)
+			}
+		})
+	}
+}
+
+func TestDiskMessageStoreRefusesCorruption(t *testing.T) {
+	// overwrite replaces bytes of a log and tears the index after it, so the
+	// index no longer covers the log and is rebuilt from it
+	overwrite := func(t *testing.T, log, index string, offset int64, data []byte) {
+		t.Helper()
+		file, err := os.OpenFile(log, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ignore(file.Close)
+		if _, err = file.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		appendFile(t, index, make([]byte, indexEntrySize/2))
+	}
+	tests := []struct {
+		name string
+		// damage is given the files of every segment, oldest first
+		damage func(t *testing.T, logs, indexes []string)
+	}{
+		{
+			name: "bad checksum at the tail",
+			damage: func(t *testing.T, logs, _ []string) {
+				payload := []byte(`{"id":"` + uuid.NewString() + `","room":"general","seq":11}`)
+				header := make([]byte, recordHeaderSize)
+				binary.BigEndian.PutUint32(header, uint32(len(payload)))
+				binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload)+1)
+				appendFile(t, logs[len(logs)-1], append(header, payload...))
+			},
+		},
+		{
+			name: "damaged payload in the newest segment",
+			damage: func(t *testing.T, logs, indexes []string) {
+				overwrite(t, logs[len(logs)-1], indexes[len(indexes)-1], recordHeaderSize+2, []byte("XX"))
+			},
+		},
+		{
+			// A torn tail would look the same without the records after it
+			name: "damaged length in the newest segment",
+			damage: func(t *testing.T, logs, indexes []string) {
+				overwrite(t, logs[len(logs)-1], indexes[len(indexes)-1], 0, []byte{0, 0xff, 0xff, 0xff})
+			},
+		},
+		{
+			name: "torn tail of an older segment",
+			damage: func(t *testing.T, logs, _ []string) {
+				info, err := os.Stat(logs[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = os.Truncate(logs[0], info.Size()-3); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestStore(t, dir)
+			appendTestMessages(t, store, 10)
+			room, err := store.room(testRoom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logs, indexes []string
+			for _, seg := range room.segments {
+				logs = append(logs, segmentPath(room.dir, seg.base, segmentLogExtension))
+				indexes = append(indexes, segmentPath(room.dir, seg.base, segmentIndexExtension))
+			}
+			if err = store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			test.damage(t, logs, indexes)
+
+			store = openTestStore(t, dir)
+			defer ignore(store.Close)
+			_, err = store.LastSeq(context.Background(), testRoom)
+			if !errors.Is(err, errCorruptRecord) && !errors.Is(err, errTornRecord) {
+				t.Errorf("opening the room got %v, want it refused", err)
+			}
+		})
+	}
+}
+
+func TestDiskMessageStoreRollsBackFailedWrites(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+	appendTestMessages(t, store, 3)
+	room, err := store.room(testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index can neither be written nor truncated, so the record is cut off the log
+	// and the room takes no more writes
+	seg := room.segments[len(room.segments)-1]
+	ignore(seg.index.Close)
+	if seg.index, err = os.Open(segmentPath(room.dir, seg.base, segmentIndexExtension)); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err = store.Append(context.Background(), newTestMessage("lost")); err == nil {
+			t.Fatal("append succeeded without its index entry")
+		}
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, dir)
+	defer ignore(store.Close)
+	last, err := store.LastSeq(context.Background(), testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != 3 {
+		t.Errorf("last seq %d after reopening, want the 3 acknowledged messages", last)
+	}
+}
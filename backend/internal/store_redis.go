@@ -0,0 +1,536 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// With MESSAGE_STORE=redis rooms, messages, receipts and mentions live in Redis,
+// so every instance of the service works on the same state. The keys of a room
+// share the {room} hash tag:
+//   - raccoon:messages:{room} hashes sequence numbers to the JSON of the messages
+//   - raccoon:messages:{room}:seq counts the messages of the room
+//   - raccoon:messages:{room}:ids hashes message ids to sequence numbers
+//   - raccoon:messages:{room}:thread:<parent> is a sorted set of the sequence numbers
+//     of the replies to the parent, with an empty parent of the top-level messages
+//
+// The sequence number of a message is its hash field and not stored in the JSON.
+const (
+	redisStorePrefix   = "raccoon:"
+	redisUpdateRetries = 10
+)
+
+var errUpdateConflict = errors.New("too many concurrent updates")
+
+func newRedisStoreClient(url string) (*redis.Client, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err = client.Ping(ctx).Err(); err != nil {
+		ignore(client.Close)
+		return nil, err
+	}
+	return client, nil
+}
+
+// updateWatched runs fn in a transaction watching the key, fn is run again
+// when the key changed before the transaction was executed
+func updateWatched(ctx context.Context, client *redis.Client, key string, fn func(tx *redis.Tx) error) error {
+	for range redisUpdateRetries {
+		err := client.Watch(ctx, fn, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errUpdateConflict
+}
+
+func messagesKey(room string) string {
+	return redisStorePrefix + "messages:{" + room + "}"
+}
+
+func threadKey(room, parentId string) string {
+	return messagesKey(room) + ":thread:" + parentId
+}
+
+// appendScript checks the thread parent and assigns the next sequence number
+var appendScript = redis.NewScript(`
+if ARGV[3] ~= '' and redis.call('HEXISTS', KEYS[3], ARGV[3]) == 0 then
+  return 0
+end
+local seq = redis.call('INCR', KEYS[2])
+redis.call('HSET', KEYS[1], seq, ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[2], seq)
+redis.call('ZADD', KEYS[4], seq, seq)
+return seq
+`)
+
+// RedisMessageStore shares the messages between every instance of the service
+type RedisMessageStore struct {
+	client *redis.Client
+}
+
+func NewRedisMessageStore(url string) (*RedisMessageStore, error) {
+	client, err := newRedisStoreClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisMessageStore{client: client}, nil
+}
+
+func decodeMessage(seq uint64, data string) (*Message, error) {
+	var message Message
+	if err := json.Unmarshal([]byte(data), &message); err != nil {
+		return nil, err
+	}
+	message.Seq = seq
+	return &message, nil
+}
+
+func (s *RedisMessageStore) Append(ctx context.Context, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	key := messagesKey(message.Room)
+	keys := []string{key, key + ":seq", key + ":ids", threadKey(message.Room, message.ParentId)}
+	seq, err := appendScript.Run(ctx, s.client, keys, data, message.Id, message.ParentId).Uint64()
+	if err != nil {
+		return err
+	}
+	if seq == 0 {
+		return ErrMessageNotFound
+	}
+	message.Seq = seq
+	return nil
+}
+
+func (s *RedisMessageStore) seq(ctx context.Context, client redis.Cmdable, room, id string) (uint64, error) {
+	seq, err := client.HGet(ctx, messagesKey(room)+":ids", id).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrMessageNotFound
+	}
+	return seq, err
+}
+
+func (s *RedisMessageStore) get(ctx context.Context, client redis.Cmdable, room, id string) (*Message, error) {
+	seq, err := s.seq(ctx, client, room, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.HGet(ctx, messagesKey(room), strconv.FormatUint(seq, 10)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(seq, data)
+}
+
+func (s *RedisMessageStore) Get(ctx context.Context, room, id string) (*Message, error) {
+	return s.get(ctx, s.client, room, id)
+}
+
+func (s *RedisMessageStore) Update(
+	ctx context.Context,
+	room, id string,
+	fn func(message *Message) error,
+) (*Message, error) {
+	var updated *Message
+	key := messagesKey(room)
+	err := updateWatched(ctx, s.client, key, func(tx *redis.Tx) error {
+		message, err := s.get(ctx, tx, room, id)
+		if err != nil {
+			return err
+		}
+		if err = fn(message); err != nil {
+			return err
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.HSet(ctx, key, strconv.FormatUint(message.Seq, 10), data).Err()
+		})
+		updated = message
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// load reads the messages with the sequence numbers, in the same order
+func (s *RedisMessageStore) load(ctx context.Context, room string, seqs []uint64) ([]*Message, error) {
+	if len(seqs) == 0 {
+		return []*Message{}, nil
+	}
+	fields := make([]string, len(seqs))
+	for i, seq := range seqs {
+		fields[i] = strconv.FormatUint(seq, 10)
+	}
+	values, err := s.client.HMGet(ctx, messagesKey(room), fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Message, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			return nil, ErrMessageNotFound
+		}
+		message, err := decodeMessage(seqs[i], data)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+func (s *RedisMessageStore) History(
+	ctx context.Context,
+	room string,
+	query HistoryQuery,
+) ([]*Message, error) {
+	if query.Thread != "" {
+		if _, err := s.seq(ctx, s.client, room, query.Thread); err != nil {
+			return nil, err
+		}
+	}
+	upper := "+inf"
+	if query.Before != 0 {
+		upper = "(" + strconv.FormatUint(query.Before, 10)
+	}
+	members, err := s.client.ZRevRangeByScore(ctx, threadKey(room, query.Thread), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   upper,
+		Count: int64(query.Limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, len(members))
+	for i, member := range members {
+		if seqs[i], err = strconv.ParseUint(member, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	slices.Reverse(seqs)
+	return s.load(ctx, room, seqs)
+}
+
+func (s *RedisMessageStore) Since(
+	ctx context.Context,
+	room string,
+	after uint64,
+	limit int,
+) ([]*Message, error) {
+	last, err := s.LastSeq(ctx, room)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for seq := after + 1; seq <= last && len(seqs) < limit; seq++ {
+		seqs = append(seqs, seq)
+	}
+	return s.load(ctx, room, seqs)
+}
+
+func (s *RedisMessageStore) LastSeq(ctx context.Context, room string) (uint64, error) {
+	last, err := s.client.Get(ctx, messagesKey(room)+":seq").Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return last, err
+}
+
+func (s *RedisMessageStore) Close() error {
+	return s.client.Close()
+}
+
+const redisRoomsKey = redisStorePrefix + "rooms"
+
+// createRoomScript stores the room unless the id is taken and adds it to the set of all rooms
+// and to the sets of rooms of its members, KEYS[3] onwards
+var createRoomScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX') then
+  return 0
+end
+for i = 2, #KEYS do
+  redis.call('SADD', KEYS[i], ARGV[2])
+end
+return 1
+`)
+
+// RedisRoomStore keeps every room under its own key, their ids in raccoon:rooms
+// and the ids of the rooms of every member in raccoon:member-of:<user key>
+type RedisRoomStore struct {
+	client *redis.Client
+}
+
+func NewRedisRoomStore(url string) (*RedisRoomStore, error) {
+	client, err := newRedisStoreClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisRoomStore{client: client}, nil
+}
+
+func roomKey(id string) string {
+	return redisStorePrefix + "room:" + id
+}
+
+func memberOfKey(tenant, username string) string {
+	return redisStorePrefix + "member-of:" + UserKey(tenant, username)
+}
+
+func (s *RedisRoomStore) Create(ctx context.Context, room *Room) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+	keys := []string{roomKey(room.Id), redisRoomsKey}
+	for username := range room.Members {
+		keys = append(keys, memberOfKey(room.Tenant, username))
+	}
+	created, err := createRoomScript.Run(ctx, s.client, keys, data, room.Id).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return ErrRoomExists
+	}
+	return nil
+}
+
+func (s *RedisRoomStore) get(ctx context.Context, client redis.Cmdable, id string) (*Room, error) {
+	data, err := client.Get(ctx, roomKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var room Room
+	if err = json.Unmarshal(data, &room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *RedisRoomStore) Get(ctx context.Context, id string) (*Room, error) {
+	return s.get(ctx, s.client, id)
+}
+
+func (s *RedisRoomStore) List(ctx context.Context, filter func(room *Room) bool) ([]*Room, error) {
+	return s.list(ctx, redisRoomsKey, filter)
+}
+
+func (s *RedisRoomStore) MemberOf(ctx context.Context, tenant, username string) ([]*Room, error) {
+	return s.list(ctx, memberOfKey(tenant, username), func(room *Room) bool {
+		_, ok := room.Members[username]
+		return ok
+	})
+}
+
+// list loads the rooms whose ids are in the set under key
+func (s *RedisRoomStore) list(ctx context.Context, key string, filter func(room *Room) bool) ([]*Room, error) {
+	ids, err := s.client.SMembers(ctx, key).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = roomKey(id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Room
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var room Room
+		if err = json.Unmarshal([]byte(data), &room); err != nil {
+			return nil, err
+		}
+		if filter(&room) {
+			result = append(result, &room)
+		}
+	}
+	return result, nil
+}
+
+func (s *RedisRoomStore) Update(
+	ctx context.Context,
+	id string,
+	fn func(room *Room) error,
+) (*Room, error) {
+	var updated *Room
+	err := updateWatched(ctx, s.client, roomKey(id), func(tx *redis.Tx) error {
+		room, err := s.get(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		previous := room.clone()
+		if err = fn(room); err != nil {
+			return err
+		}
+		data, err := json.Marshal(room)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for username := range previous.Members {
+				if _, ok := room.Members[username]; !ok {
+					pipe.SRem(ctx, memberOfKey(room.Tenant, username), id)
+				}
+			}
+			for username := range room.Members {
+				if _, ok := previous.Members[username]; !ok {
+					pipe.SAdd(ctx, memberOfKey(room.Tenant, username), id)
+				}
+			}
+			return pipe.Set(ctx, roomKey(id), data, 0).Err()
+		})
+		updated = room
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// markReadScript only ever moves the receipt forward
+var markReadScript = redis.NewScript(`
+local previous = tonumber(redis.call('HGET', KEYS[1], ARGV[1])) or 0
+if tonumber(ARGV[2]) <= previous then
+  return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// RedisReceiptStore hashes the rooms of every user to their receipts
+type RedisReceiptStore struct {
+	client *redis.Client
+}
+
+func NewRedisReceiptStore(url string) (*RedisReceiptStore, error) {
+	client, err := newRedisStoreClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisReceiptStore{client: client}, nil
+}
+
+func receiptsKey(tenant, username string) string {
+	return redisStorePrefix + "receipts:" + UserKey(tenant, username)
+}
+
+func (s *RedisReceiptStore) MarkRead(ctx context.Context, room, tenant, username string, seq uint64) (bool, error) {
+	advanced, err := markReadScript.Run(ctx, s.client, []string{receiptsKey(tenant, username)}, room, seq).Int()
+	return advanced == 1, err
+}
+
+func (s *RedisReceiptStore) LastRead(ctx context.Context, tenant, username string) (map[string]uint64, error) {
+	values, err := s.client.HGetAll(ctx, receiptsKey(tenant, username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	receipts := make(map[string]uint64, len(values))
+	for room, value := range values {
+		if receipts[room], err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return receipts, nil
+}
+
+// RedisMentionStore keeps the mentions of every user in a sorted set scored by
+// their sequence number, which is counted in a key of its own
+type RedisMentionStore struct {
+	client *redis.Client
+}
+
+func NewRedisMentionStore(url string) (*RedisMentionStore, error) {
+	client, err := newRedisStoreClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisMentionStore{client: client}, nil
+}
+
+func mentionsKey(tenant, username string) string {
+	return redisStorePrefix + "mentions:" + UserKey(tenant, username)
+}
+
+func (s *RedisMentionStore) Add(ctx context.Context, tenant string, usernames []string, record MentionRecord) error {
+	seqs := make([]*redis.IntCmd, len(usernames))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, username := range usernames {
+			seqs[i] = pipe.Incr(ctx, mentionsKey(tenant, username)+":seq")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, username := range usernames {
+			record.Seq = uint64(seqs[i].Val())
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			key := mentionsKey(tenant, username)
+			pipe.ZAdd(ctx, key, redis.Z{Score: float64(record.Seq), Member: data})
+			pipe.ZRemRangeByRank(ctx, key, 0, -MaxStoredMentions-1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *RedisMentionStore) List(
+	ctx context.Context,
+	tenant, username string,
+	query HistoryQuery,
+) ([]MentionRecord, error) {
+	upper := "+inf"
+	if query.Before != 0 {
+		upper = "(" + strconv.FormatUint(query.Before, 10)
+	}
+	members, err := s.client.ZRevRangeByScore(ctx, mentionsKey(tenant, username), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   upper,
+		Count: int64(query.Limit),
+	}).Result()
+	if err != nil || len(members) == 0 {
+		return nil, err
+	}
+	records := make([]MentionRecord, len(members))
+	for i, member := range members {
+		if err = json.Unmarshal([]byte(member), &records[len(members)-1-i]); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
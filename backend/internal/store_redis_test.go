@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.uber.org/zap"
+)
+
+func startRedis(t *testing.T) string {
+	t.Helper()
+	server := miniredis.RunT(t)
+	return "redis://" + server.Addr()
+}
+
+func messageSeqs(messages []*Message) []uint64 {
+	seqs := make([]uint64, len(messages))
+	for i, message := range messages {
+		seqs[i] = message.Seq
+	}
+	return seqs
+}
+
+func TestRedisMessageStore(t *testing.T) {
+	url := startRedis(t)
+	ctx := context.Background()
+	writer, err := NewRedisMessageStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignore(writer.Close)
+	// Another instance of the service
+	reader, err := NewRedisMessageStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ignore(reader.Close)
+
+	messages := appendTestMessages(t, writer, 5)
+	reply := newTestMessage("reply")
+	reply.ParentId = messages[1].Id
+	if err = writer.Append(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+	appendTestMessages(t, writer, 2)
+	orphan := newTestMessage("orphan")
+	orphan.ParentId = "missing"
+	if err = writer.Append(ctx, orphan); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("reply to a missing message got %v", err)
+	}
+	_, err = writer.Update(ctx, testRoom, messages[0].Id, func(m *Message) error {
+		m.Edit("edited", time.Now().UTC())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := reader.LastSeq(ctx, testRoom)
+	if err != nil || last != 8 {
+		t.Fatalf("last seq %d, %v, want 8", last, err)
+	}
+	edited, err := reader.Get(ctx, testRoom, messages[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Seq != 1 || edited.Body != "edited" || len(edited.Revisions) != 1 {
+		t.Errorf("got %+v, want the edit of the first message", edited)
+	}
+	if _, err = reader.Get(ctx, "other", messages[0].Id); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("message of another room got %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []uint64
+	}{
+		{name: "latest page", query: HistoryQuery{Limit: 3}, want: []uint64{5, 7, 8}},
+		{name: "before", query: HistoryQuery{Before: 5, Limit: 3}, want: []uint64{2, 3, 4}},
+		{name: "first page", query: HistoryQuery{Before: 3, Limit: 3}, want: []uint64{1, 2}},
+		{name: "thread", query: HistoryQuery{Thread: messages[1].Id, Limit: 3}, want: []uint64{6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history, err := reader.History(ctx, testRoom, test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seqs := messageSeqs(history); !slices.Equal(seqs, test.want) {
+				t.Errorf("got %v, want %v", seqs, test.want)
+			}
+		})
+	}
+	if _, err = reader.History(ctx, testRoom, HistoryQuery{Thread: "missing", Limit: 3}); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("missing thread got %v", err)
+	}
+
+	since, err := reader.Since(ctx, testRoom, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqs := messageSeqs(since); !slices.Equal(seqs, []uint64{6, 7}) {
+		t.Errorf("since got %v, want [6 7]", seqs)
+	}
+}
+
+func TestRedisRoomStore(t *testing.T) {
+	url := startRedis(t)
+	ctx := context.Background()
+	writer, err := NewRedisRoomStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewRedisRoomStore(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := &Room{Id: testRoom, Tenant: DefaultTenant, Members: map[string]Role{"alice": RoleOwner}}
+	if err = writer.Create(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Create(ctx, room); !errors.Is(err, ErrRoomExists) {
+		t.Errorf("second create got %v", err)
+	}
+	_, err = writer.Update(ctx, testRoom, func(room *Room) error {
+		room.Members["bob"] = RoleMember
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Update(ctx, testRoom, func(room *Room) error {
+		room.Members["carol"] = RoleMember
+		return errForbidden
+	})
+	if !errors.Is(err, errForbidden) {
+		t.Errorf("failed update got %v", err)
+	}
+	if _, err = reader.Update(ctx, "missing", func(*Room) error { return nil }); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("update of a missing room got %v", err)
+	}
+
+	stored, err := reader.Get(ctx, testRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Members) != 2 || stored.Members["bob"] != RoleMember {
+		t.Errorf("members %v, want alice and bob", stored.Members)
+	}
+	shared, err := SharesRoom(ctx, reader, DefaultTenant, "alice", "bob")
+	if err != nil || !shared {
+		t.Errorf("alice and bob share a room: %v, %v", shared, err)
+	}
+	shared, err = SharesRoom(ctx, reader, "acme", "alice", "bob")
+	if err != nil || shared {
+		t.Errorf("alice and bob of another tenant share a room: %v, %v", shared, err)
+	}
+}
+
+func TestRedisReceiptStore(t *testing.T) {
+	store, err := NewRedisReceiptStore(startRedis(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tests := []struct {
+		tenant   string
+		seq      uint64
+		advanced bool
+	}{
+		{tenant: DefaultTenant, seq: 3, advanced: true},
+		{tenant: DefaultTenant, seq: 2, advanced: false},
+		{tenant: DefaultTenant, seq: 3, advanced: false},
+		{tenant: DefaultTenant, seq: 5, advanced: true},
+		{tenant: "acme", seq: 1, advanced: true},
+	}
+	for _, test := range tests {
+		advanced, err := store.MarkRead(ctx, testRoom, test.tenant, "alice", test.seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advanced != test.advanced {
+			t.Errorf("marking %d read in %s advanced %v", test.seq, test.tenant, advanced)
+		}
+	}
+	for tenant, want := range map[string]uint64{DefaultTenant: 5, "acme": 1} {
+		receipts, err := store.LastRead(ctx, tenant, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipts[testRoom] != want {
+			t.Errorf("last read in %s is %d, want %d", tenant, receipts[testRoom], want)
+		}
+	}
+}
+
+func TestRedisMentionStore(t *testing.T) {
+	store, err := NewRedisMentionStore(startRedis(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := range MaxStoredMentions + 5 {
+		record := MentionRecord{Room: testRoom, MessageId: string(rune('a' + i%26))}
+		if err = store.Add(ctx, DefaultTenant, []string{"alice", "bob"}, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.Add(ctx, "acme", []string{"alice"}, MentionRecord{Room: "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := store.List(ctx, DefaultTenant, "alice", HistoryQuery{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 3 || latest[0].Seq != MaxStoredMentions+3 || latest[2].Seq != MaxStoredMentions+5 {
+		t.Errorf("latest mentions %+v", latest)
+	}
+	oldest, err := store.List(ctx, DefaultTenant, "alice", HistoryQuery{Before: 8, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first five were trimmed
+	if len(oldest) != 2 || oldest[0].Seq != 6 {
+		t.Errorf("oldest mentions %+v, want 6 and 7", oldest)
+	}
+	other, err := store.List(ctx, "acme", "alice", HistoryQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 1 || other[0].Room != "other" {
+		t.Errorf("mentions of alice in another tenant %+v", other)
+	}
+}
+
+func TestHubsShareRedisStores(t *testing.T) {
+	config := &Config{}
+	config.SetDefaults()
+	config.MessageStore = MessageStoreRedis
+	config.Broker = BrokerRedis
+	config.RedisUrl = startRedis(t)
+	hubs := make([]*testHub, 2)
+	for i := range hubs {
+		broker, err := NewRedisBroker(context.Background(), config.RedisUrl, config.RedisChannel, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ignore(broker.Close) })
+		hubs[i] = newConfiguredHub(t, config, broker)
+	}
+	// The room is created through one instance and used through the other
+	hubs[0].createRoom(t, testRoom, "alice", "bob")
+	alice := hubs[0].connect(t, DefaultTenant, "alice")
+	bob := hubs[1].connect(t, DefaultTenant, "bob")
+	hubs[0].HandleFrame(alice, &Frame{Type: FrameJoin, Room: testRoom})
+	hubs[1].HandleFrame(bob, &Frame{Type: FrameJoin, Room: testRoom})
+	hubs[1].HandleFrame(bob, &Frame{Type: FrameMessage, Room: testRoom, Body: "from the second instance"})
+	hubs[0].HandleFrame(alice, &Frame{Type: FrameMessage, Room: testRoom, Body: "from the first instance"})
+
+	var seqs []uint64
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seqs) < 2 && time.Now().Before(deadline) {
+		// Presence frames of bob come in as well
+		for _, frame := range received(alice) {
+			if frame.Type == FrameMessage {
+				seqs = append(seqs, frame.Seq)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !slices.Equal(seqs, []uint64{1, 2}) {
+		t.Errorf("alice got the messages %v, want 1 and 2 in order", seqs)
+	}
+}
+
+func TestConfigRejectsLocalStoresWithRedisBroker(t *testing.T) {
+	tests := []struct {
+		store string
+		err   bool
+	}{
+		{store: MessageStoreMemory, err: true},
+		{store: MessageStoreDisk, err: true},
+		{store: MessageStoreRedis, err: false},
+	}
+	for _, test := range tests {
+		config := &Config{}
+		config.SetDefaults()
+		config.OpenIdConfigurationUrl = "https://idp.example.com/.well-known/openid-configuration"
+		config.Region = "eu-west-1"
+		config.UserPoolId = "pool"
+		config.AvatarsBucketName = "avatars"
+		config.MessageStoreDir = t.TempDir()
+		config.Broker = BrokerRedis
+		config.RedisUrl = "redis://localhost:6379"
+		config.MessageStore = test.store
+		if err := config.Validate(); (err != nil) != test.err {
+			t.Errorf("%s store with the redis broker got %v", test.store, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ticketBytes  = 32
+	ticketPrefix = redisStorePrefix + "ticket:"
+)
+
+var ErrTicketNotFound = errors.New("ticket not found")
+
+type Ticket struct {
+	Token     *jwt.Token
+	Tenant    string
+	ExpiresAt time.Time
+}
+
+// TicketStore hands out short-lived, single-use tickets which let a browser
+// authenticate the WebSocket handshake without an Authorization header.
+// Redeem returns ErrTicketNotFound for unknown, used and expired tickets.
+type TicketStore interface {
+	Issue(ctx context.Context, token *jwt.Token, tenant string) (string, *Ticket, error)
+	Redeem(ctx context.Context, id string) (*Ticket, error)
+}
+
+// NewTicketStore shares the tickets through Redis when several instances run
+// behind the load balancer, the handshake may reach another one than the request
+// issuing the ticket
+func NewTicketStore(config *Config) (TicketStore, error) {
+	switch config.Broker {
+	case BrokerRedis:
+		return NewRedisTicketStore(config.RedisUrl, config.WsTicketTtl)
+	default:
+		return NewMemoryTicketStore(config.WsTicketTtl), nil
+	}
+}
+
+func newTicket(token *jwt.Token, tenant string, ttl time.Duration) (string, *Ticket, error) {
+	buf := make([]byte, ticketBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	ticket := &Ticket{
+		Token:     token,
+		Tenant:    tenant,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), ticket, nil
+}
+
+// MemoryTicketStore keeps the tickets of a single instance
+type MemoryTicketStore struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	tickets map[string]*Ticket
+}
+
+func NewMemoryTicketStore(ttl time.Duration) *MemoryTicketStore {
+	return &MemoryTicketStore{
+		ttl:     ttl,
+		tickets: make(map[string]*Ticket),
+	}
+}
+
+func (s *MemoryTicketStore) Issue(
+	_ context.Context,
+	token *jwt.Token,
+	tenant string,
+) (string, *Ticket, error) {
+	id, ticket, err := newTicket(token, tenant, s.ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, value := range s.tickets {
+		if now.After(value.ExpiresAt) {
+			delete(s.tickets, key)
+		}
+	}
+	s.tickets[id] = ticket
+	return id, ticket, nil
+}
+
+func (s *MemoryTicketStore) Redeem(_ context.Context, id string) (*Ticket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ticket, ok := s.tickets[id]
+	if !ok {
+		return nil, ErrTicketNotFound
+	}
+	delete(s.tickets, id)
+	if time.Now().After(ticket.ExpiresAt) {
+		return nil, ErrTicketNotFound
+	}
+	return ticket, nil
+}
+
+// redisTicket is a ticket as stored in Redis, the token was validated before
+// it was issued and is parsed again without checking its signature
+type redisTicket struct {
+	Token     string    `json:"token"`
+	Tenant    string    `json:"tenant"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RedisTicketStore keeps every ticket under raccoon:ticket:<id> until it expires
+type RedisTicketStore struct {
+	client *redis.Client
+	ttl    time.Duration
+	parser *jwt.Parser
+}
+
+func NewRedisTicketStore(url string, ttl time.Duration) (*RedisTicketStore, error) {
+	client, err := newRedisStoreClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisTicketStore{client: client, ttl: ttl, parser: jwt.NewParser()}, nil
+}
+
+func (s *RedisTicketStore) Issue(
+	ctx context.Context,
+	token *jwt.Token,
+	tenant string,
+) (string, *Ticket, error) {
+	id, ticket, err := newTicket(token, tenant, s.ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(&redisTicket{
+		Token:     token.Raw,
+		Tenant:    tenant,
+		ExpiresAt: ticket.ExpiresAt,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if err = s.client.Set(ctx, ticketPrefix+id, data, s.ttl).Err(); err != nil {
+		return "", nil, err
+	}
+	return id, ticket, nil
+}
+
+func (s *RedisTicketStore) Redeem(ctx context.Context, id string) (*Ticket, error) {
+	data, err := s.client.GetDel(ctx, ticketPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrTicketNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored redisTicket
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrTicketNotFound
+	}
+	token, _, err := s.parser.ParseUnverified(stored.Token, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	token.Valid = true
+	return &Ticket{Token: token, Tenant: stored.Tenant, ExpiresAt: stored.ExpiresAt}, nil
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTicketStore(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T, ttl time.Duration) TicketStore
+	}{
+		{
+			name: "memory",
+			open: func(_ *testing.T, ttl time.Duration) TicketStore { return NewMemoryTicketStore(ttl) },
+		},
+		{
+			name: "redis",
+			open: func(t *testing.T, ttl time.Duration) TicketStore {
+				store, err := NewRedisTicketStore(startRedis(t), ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+		},
+	}
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// redeem gets the id of the issued ticket and returns the one to redeem
+		redeem func(t *testing.T, store TicketStore, id string) string
+		ok     bool
+	}{
+		{
+			name:   "fresh",
+			ttl:    time.Minute,
+			redeem: func(_ *testing.T, _ TicketStore, id string) string { return id },
+			ok:     true,
+		},
+		{
+			name: "used twice",
+			ttl:  time.Minute,
+			redeem: func(t *testing.T, store TicketStore, id string) string {
+				if _, err := store.Redeem(context.Background(), id); err != nil {
+					t.Fatalf("the first redeem failed: %v", err)
+				}
+				return id
+			},
+		},
+		{
+			name: "expired",
+			ttl:  10 * time.Millisecond,
+			redeem: func(_ *testing.T, _ TicketStore, id string) string {
+				time.Sleep(20 * time.Millisecond)
+				return id
+			},
+		},
+		{
+			name:   "unknown",
+			ttl:    time.Minute,
+			redeem: func(_ *testing.T, _ TicketStore, id string) string { return id + "x" },
+		},
+	}
+	ctx := context.Background()
+	for _, s := range stores {
+		for _, test := range tests {
+			t.Run(s.name+"/"+test.name, func(t *testing.T) {
+				store := s.open(t, test.ttl)
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+					CognitoUsernameClaim: "alice",
+				}).SignedString([]byte("secret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				parsed.Valid = true
+				id, issued, err := store.Issue(ctx, parsed, "acme")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if other, _, _ := store.Issue(ctx, parsed, "acme"); other == id {
+					t.Fatal("two tickets got the same id")
+				}
+				ticket, err := store.Redeem(ctx, test.redeem(t, store, id))
+				if test.ok != (err == nil) {
+					t.Fatalf("redeem got %v, want ok %v", err, test.ok)
+				}
+				if !test.ok {
+					if !errors.Is(err, ErrTicketNotFound) {
+						t.Errorf("redeem got %v, want %v", err, ErrTicketNotFound)
+					}
+					return
+				}
+				username, _ := GetTokenUsername(ticket.Token)
+				if !ticket.Token.Valid || username != "alice" || ticket.Tenant != "acme" ||
+					!ticket.ExpiresAt.Equal(issued.ExpiresAt) {
+					t.Errorf("redeemed %+v, want the issued ticket", ticket)
+				}
+			})
+		}
+	}
+}
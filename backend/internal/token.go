@@ -2,141 +2,216 @@ package internal
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
-	"golang.org/x/sync/singleflight"
 )
 
-type OpenIdConfig struct {
-	Issuer string `json:"issuer"`
-}
-
+// TokenValidator accepts the tokens of the issuers of every tenant,
+// the issuer is picked by the iss claim before the signature is checked
 type TokenValidator struct {
-	Config          *Config
-	client          *http.Client
-	openIdConfig    *OpenIdConfig
-	jwksHash        string
-	jwks            map[string]*rsa.PublicKey
-	group           singleflight.Group
-	logger          *zap.Logger
-	lastJwksRefresh time.Time
-	parser          *jwt.Parser
+	Config   *Config
+	client   *http.Client
+	issuers  []*Issuer
+	byIssuer map[string]*Issuer
+	logger   *zap.Logger
+	parser   *jwt.Parser
 }
 
 func NewTokenValidator(config *Config, logger *zap.Logger) *TokenValidator {
 	return &TokenValidator{
-		Config: config,
-		client: &http.Client{},
-		logger: logger,
-		parser: jwt.NewParser(),
+		Config:   config,
+		client:   &http.Client{},
+		byIssuer: make(map[string]*Issuer),
+		logger:   logger,
+		parser:   jwt.NewParser(jwt.WithValidMethods(SigningAlgorithms)),
 	}
 }
 
+// LoadOpenIdConfig discovers the issuers of every tenant, the keys
+// are loaded with LoadJwks
 func (t *TokenValidator) LoadOpenIdConfig(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", t.Config.OpenIdConfigurationUrl, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := t.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer ignore(resp.Body.Close)
-	var config OpenIdConfig
-	if err = json.NewDecoder(resp.Body).Decode(&config); err != nil {
-		return err
+	for _, tenant := range t.Config.TenantConfigs() {
+		issuer := NewIssuer(tenant, t.logger)
+		if err := issuer.LoadOpenIdConfig(ctx, t.client, t.Config); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.Id, err)
+		}
+		name := issuer.openIdConfig.Issuer
+		if other, ok := t.byIssuer[name]; ok {
+			return fmt.Errorf("tenants %s and %s share the issuer %s", other.Tenant, tenant.Id, name)
+		}
+		t.issuers = append(t.issuers, issuer)
+		t.byIssuer[name] = issuer
 	}
-	t.openIdConfig = &config
-	issuerOpt := jwt.WithIssuer(t.openIdConfig.Issuer)
-	issuerOpt(t.parser)
-	t.logger.Info("OpenId configuration loaded")
 	return nil
 }
 
 func (t *TokenValidator) LoadJwks(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", t.Config.JwksUrl, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := t.client.Do(req)
-	if err != nil {
-		return err
+	for _, issuer := range t.issuers {
+		if err := issuer.jwks.Load(ctx); err != nil {
+			return fmt.Errorf("tenant %s: %w", issuer.Tenant, err)
+		}
 	}
-	defer ignore(resp.Body.Close)
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	return nil
+}
+
+// RefreshJwks keeps the keys of every issuer fresh until the context is done
+func (t *TokenValidator) RefreshJwks(ctx context.Context) {
+	var group sync.WaitGroup
+	for _, issuer := range t.issuers {
+		group.Go(func() {
+			issuer.jwks.Run(ctx)
+		})
 	}
-	hash := sha256.Sum256(data)
-	t.jwksHash = hex.EncodeToString(hash[:])
-	var jwks JWKS
-	if err = json.Unmarshal(data, &jwks); err != nil {
-		return err
+	group.Wait()
+}
+
+func (t *TokenValidator) GetJwksDiagnostics(w http.ResponseWriter, _ *http.Request) {
+	diagnostics := make([]*IssuerDiagnostics, 0, len(t.issuers))
+	for _, issuer := range t.issuers {
+		diagnostics = append(diagnostics, issuer.Diagnostics())
 	}
-	rsaMap, err := jwks.ToRSAMap()
-	if err != nil {
-		return err
+	WriteJSON(w, diagnostics, http.StatusOK)
+}
+
+// Tenant returns the tenant of a validated token
+func (t *TokenValidator) Tenant(token *jwt.Token) string {
+	name, _ := token.Claims.GetIssuer()
+	if issuer, ok := t.byIssuer[name]; ok {
+		return issuer.Tenant
 	}
-	t.jwks = rsaMap
-	t.lastJwksRefresh = time.Now()
-	t.logger.Info("JWKS refreshed")
-	return nil
+	return ""
 }
 
 type parsedTokenKey struct{}
 
-var ParsedContextTokenKey = parsedTokenKey{}
+type tenantKey struct{}
+
+var (
+	ParsedContextTokenKey = parsedTokenKey{}
+	TenantContextKey      = tenantKey{}
+)
+
+const (
+	JwtKid                = "kid"
+	Bearer                = "Bearer"
+	HeaderWWWAuthenticate = "WWW-Authenticate"
+	CognitoTokenUseClaim  = "token_use"
+	CognitoClientIdClaim  = "client_id"
+	ScopeClaim            = "scope"
+)
 
+// Error codes of the WWW-Authenticate header, insufficient_scope
+// is answered with 403 and the others with 401
 const (
-	JwtKid = "kid"
-	Bearer = "Bearer"
+	TokenErrorInvalidRequest    = "invalid_request"
+	TokenErrorInvalidToken      = "invalid_token"
+	TokenErrorInsufficientScope = "insufficient_scope"
+)
+
+var (
+	errUnknownIssuer     = errors.New("unknown issuer")
+	errUnknownKey        = errors.New("unknown signing key")
+	errAlgorithmMismatch = errors.New("algorithm does not match the signing key")
 )
 
+// pinnedKey only hands out the key for the algorithms of its JWK, so a token
+// can not pick how the signature is checked
+func pinnedKey(token *jwt.Token, key *Key) (any, error) {
+	if !slices.Contains(key.Algs, token.Method.Alg()) {
+		return nil, errAlgorithmMismatch
+	}
+	return key.Public, nil
+}
+
+// TokenError is a rejected token, the code and description are
+// sent back in the WWW-Authenticate header as in RFC 6750
+type TokenError struct {
+	Code        string
+	Description string
+	// Scope lists the required scopes of an insufficient_scope error
+	Scope string
+}
+
+func (e *TokenError) Error() string {
+	return e.Description
+}
+
+func (e *TokenError) Challenge() string {
+	challenge := fmt.Sprintf("%s error=%q, error_description=%q", Bearer, e.Code, e.Description)
+	if e.Scope != "" {
+		challenge += fmt.Sprintf(", scope=%q", e.Scope)
+	}
+	return challenge
+}
+
+func invalidToken(format string, args ...any) *TokenError {
+	return &TokenError{Code: TokenErrorInvalidToken, Description: fmt.Sprintf(format, args...)}
+}
+
+// describeParseError names the check that failed without echoing the token
+func describeParseError(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return "malformed token"
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "token expired"
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "token not valid yet"
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer), errors.Is(err, errUnknownIssuer):
+		return "invalid issuer"
+	case errors.Is(err, errUnknownKey):
+		return "unknown signing key"
+	case errors.Is(err, errAlgorithmMismatch):
+		return "signing algorithm does not match the key"
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return "invalid signature"
+	default:
+		return "invalid token"
+	}
+}
+
+// ValidateToken returns a *TokenError when the token is rejected,
+// other errors mean the token could not be checked
 func (t *TokenValidator) ValidateToken(
 	c context.Context,
 	tokenStr string,
 ) (bool, *jwt.Token, error) {
+	var jwksErr error
+	var issuer *Issuer
 	token, err := t.parser.Parse(tokenStr, func(tkn *jwt.Token) (any, error) {
-		kid, ok := tkn.Header[JwtKid]
-		if !ok {
-			return false, nil
+		// Only the keys of the issuer named by the token can verify it
+		name, _ := tkn.Claims.GetIssuer()
+		var ok bool
+		if issuer, ok = t.byIssuer[name]; !ok {
+			return nil, errUnknownIssuer
 		}
-		keyId := kid.(string)
-		key, ok := t.jwks[keyId]
+		keyId, ok := tkn.Header[JwtKid].(string)
 		if !ok {
-			// Last JWKS refresh was more than 1 hour ago
-			if time.Now().After(t.lastJwksRefresh.Add(time.Hour)) {
-				t.logger.Info("jwk not found for token, refreshing", zap.String(JwtKid, keyId))
-				_, err, _ := t.group.Do(t.jwksHash, func() (any, error) {
-					ctx, cancel := context.WithTimeout(c, time.Second*10)
-					defer cancel()
-					return nil, t.LoadJwks(ctx)
-				})
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				t.logger.Info("JWKS refreshed recently. No need to do it")
-			}
-		} else {
-			return key, nil
+			return nil, errUnknownKey
 		}
-		key, ok = t.jwks[keyId]
-		if !ok {
-			return false, nil
+		key, err := issuer.jwks.Lookup(c, keyId)
+		if err != nil {
+			if !errors.Is(err, errUnknownKey) {
+				jwksErr = err
+			}
+			return nil, err
 		}
-		return key, nil
+		return pinnedKey(tkn, key)
 	})
+	if jwksErr != nil {
+		return false, nil, jwksErr
+	}
 	if err != nil {
+		return false, nil, invalidToken("%s", describeParseError(err))
+	}
+	if err = issuer.checkClaims(token); err != nil {
 		return false, nil, err
 	}
 	return token.Valid, token, nil
@@ -146,29 +221,56 @@ func (t *TokenValidator) ValidatingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get(HeaderAuthorization)
 		if auth == "" {
+			w.Header().Set(HeaderWWWAuthenticate, Bearer)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 		fields := strings.Fields(auth)
 		if len(fields) != 2 || fields[0] != Bearer {
-			w.WriteHeader(http.StatusUnauthorized)
-		}
-		tokenStr := fields[1]
-		valid, token, err := t.ValidateToken(r.Context(), tokenStr)
-		if err != nil {
-			t.logger.Error("Error validating token", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		if !valid {
-			w.WriteHeader(http.StatusUnauthorized)
+			t.reject(w, &TokenError{Code: TokenErrorInvalidRequest, Description: "expected a bearer token"})
 			return
 		}
-		newRequest := r.WithContext(context.WithValue(r.Context(), ParsedContextTokenKey, token))
-		next.ServeHTTP(w, newRequest)
+		t.serveWithToken(w, r, fields[1], next)
 	})
 }
 
+func (t *TokenValidator) serveWithToken(w http.ResponseWriter,
+	r *http.Request,
+	tokenStr string,
+	next http.Handler) {
+	valid, token, err := t.ValidateToken(r.Context(), tokenStr)
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) {
+		t.reject(w, tokenErr)
+		return
+	}
+	if err != nil {
+		t.logger.Error("Error validating token", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		t.reject(w, invalidToken("invalid token"))
+		return
+	}
+	next.ServeHTTP(w, r.WithContext(WithParsedToken(r.Context(), token, t.Tenant(token))))
+}
+
+func (t *TokenValidator) reject(w http.ResponseWriter, err *TokenError) {
+	t.logger.Info("Token rejected", zap.String("error", err.Code), zap.String("reason", err.Description))
+	w.Header().Set(HeaderWWWAuthenticate, err.Challenge())
+	if err.Code == TokenErrorInsufficientScope {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func WithParsedToken(ctx context.Context, token *jwt.Token, tenant string) context.Context {
+	ctx = context.WithValue(ctx, ParsedContextTokenKey, token)
+	return context.WithValue(ctx, TenantContextKey, tenant)
+}
+
 func GetParsedToken(r *http.Request) *jwt.Token {
 	val := r.Context().Value(ParsedContextTokenKey)
 	if token, ok := val.(*jwt.Token); ok {
@@ -176,3 +278,23 @@ func GetParsedToken(r *http.Request) *jwt.Token {
 	}
 	return nil
 }
+
+func GetTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(TenantContextKey).(string)
+	return tenant
+}
+
+func GetTokenUsername(token *jwt.Token) (string, error) {
+	if token == nil {
+		return "", errors.New("unable to fetch token from the request context")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", errors.New("unable to fetch claims from token")
+	}
+	username, ok := claims[CognitoUsernameClaim].(string)
+	if !ok || username == "" {
+		return "", errors.New("token has no username claim")
+	}
+	return username, nil
+}
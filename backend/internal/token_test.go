@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+const testIssuer = "https://idp.example.com/pool"
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+// newTestValidator trusts testIssuer with an RSA key pinned to RS256 as "rs",
+// the same key for any RSA algorithm as "rsa" and a P-256 key as "ec"
+func newTestValidator(t *testing.T, tenant TenantConfig) (*TokenValidator, *testKeys) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := NewTokenValidator(&Config{}, zap.NewNop())
+	issuer := NewIssuer(tenant, zap.NewNop())
+	issuer.openIdConfig = &OpenIdConfig{Issuer: testIssuer}
+	// Unknown keys are not fetched within the min interval
+	issuer.jwks = NewJwksCache("http://127.0.0.1:0/jwks", http.DefaultClient, time.Hour, time.Hour, zap.NewNop())
+	issuer.jwks.state.Store(&jwksState{
+		keys: KeySet{
+			"rs":  {Algs: []string{"RS256"}, Public: &rsaKey.PublicKey},
+			"rsa": {Algs: rsaAlgs, Public: &rsaKey.PublicKey},
+			"ec":  {Algs: []string{"ES256"}, Public: &ecKey.PublicKey},
+		},
+		refreshedAt: time.Now(),
+	})
+	validator.issuers = append(validator.issuers, issuer)
+	validator.byIssuer[testIssuer] = issuer
+	return validator, &testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key crypto.Signer, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header[JwtKid] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestValidateToken(t *testing.T) {
+	validator, keys := newTestValidator(t, TenantConfig{
+		Id:             DefaultTenant,
+		TokenUse:       []string{"access", "id"},
+		ClientIds:      []string{"web"},
+		RequiredScopes: []string{"chat"},
+	})
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":                testIssuer,
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			CognitoUsernameClaim: "alice",
+			CognitoTokenUseClaim: "access",
+			CognitoClientIdClaim: "web",
+			ScopeClaim:           "openid chat",
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		key    crypto.Signer
+		kid    string
+		claims jwt.MapClaims
+		// Empty when the token is accepted
+		code        string
+		description string
+	}{
+		{name: "access token", method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs", claims: claims(nil)},
+		{name: "RSA key without alg", method: jwt.SigningMethodPS384, key: keys.rsa, kid: "rsa", claims: claims(nil)},
+		{name: "EC key", method: jwt.SigningMethodES256, key: keys.ec, kid: "ec", claims: claims(nil)},
+		{
+			name:   "ID token of the client",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{CognitoTokenUseClaim: "id", CognitoClientIdClaim: nil, "aud": "web"}),
+		},
+		{
+			name:   "alg other than the pinned one",
+			method: jwt.SigningMethodRS512, key: keys.rsa, kid: "rs", claims: claims(nil),
+			code: TokenErrorInvalidToken, description: "signing algorithm does not match the key",
+		},
+		{
+			name:   "RSA alg with an EC key id",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "ec", claims: claims(nil),
+			code: TokenErrorInvalidToken, description: "signing algorithm does not match the key",
+		},
+		{
+			name:   "unknown key",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rotated", claims: claims(nil),
+			code: TokenErrorInvalidToken, description: "unknown signing key",
+		},
+		{
+			name:   "bad issuer",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{"iss": "https://evil.example.com"}),
+			code:   TokenErrorInvalidToken, description: "invalid issuer",
+		},
+		{
+			name:   "expired",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}),
+			code:   TokenErrorInvalidToken, description: "token expired",
+		},
+		{
+			name:   "missing token_use",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{CognitoTokenUseClaim: nil}),
+			code:   TokenErrorInvalidToken, description: `token_use "" is not allowed`,
+		},
+		{
+			name:   "other client",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{CognitoClientIdClaim: "admin"}),
+			code:   TokenErrorInvalidToken, description: `client "admin" is not allowed`,
+		},
+		{
+			name:   "ID token of another client",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{CognitoTokenUseClaim: "id", CognitoClientIdClaim: nil, "aud": "admin"}),
+			code:   TokenErrorInvalidToken, description: `client "admin" is not allowed`,
+		},
+		{
+			name:   "missing scope",
+			method: jwt.SigningMethodRS256, key: keys.rsa, kid: "rs",
+			claims: claims(jwt.MapClaims{ScopeClaim: "openid"}),
+			code:   TokenErrorInsufficientScope, description: `missing scope "chat"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed := signTestToken(t, test.method, test.key, test.kid, test.claims)
+			valid, token, err := validator.ValidateToken(context.Background(), signed)
+			if test.code == "" {
+				if err != nil || !valid {
+					t.Fatalf("rejected: %v", err)
+				}
+				if tenant := validator.Tenant(token); tenant != DefaultTenant {
+					t.Errorf("tenant %q, want %q", tenant, DefaultTenant)
+				}
+				return
+			}
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) {
+				t.Fatalf("got %v, want a token error", err)
+			}
+			if tokenErr.Code != test.code || tokenErr.Description != test.description {
+				t.Errorf("got %s %q, want %s %q", tokenErr.Code, tokenErr.Description, test.code, test.description)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsUnpinnedAlgorithms(t *testing.T) {
+	validator, _ := newTestValidator(t, TenantConfig{Id: DefaultTenant})
+	claims := jwt.MapClaims{"iss": testIssuer, "exp": time.Now().Add(time.Hour).Unix()}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{
+			name: "HMAC",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header[JwtKid] = "rs"
+				signed, err := token.SignedString([]byte("secret"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			}(),
+		},
+		{
+			name: "none",
+			token: func() string {
+				token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+				token.Header[JwtKid] = "rs"
+				signed, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signed
+			}(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := validator.ValidateToken(context.Background(), test.token)
+			var tokenErr *TokenError
+			if !errors.As(err, &tokenErr) || tokenErr.Code != TokenErrorInvalidToken {
+				t.Errorf("got %v, want an invalid token", err)
+			}
+		})
+	}
+}
+
+func TestValidateTokenPicksTheIssuerOfTheTenant(t *testing.T) {
+	validator, keys := newTestValidator(t, TenantConfig{Id: DefaultTenant})
+	other, otherKeys := newTestValidator(t, TenantConfig{Id: "acme"})
+	const acmeIssuer = "https://idp.example.com/acme"
+	acme := other.byIssuer[testIssuer]
+	acme.openIdConfig.Issuer = acmeIssuer
+	validator.issuers = append(validator.issuers, acme)
+	validator.byIssuer[acmeIssuer] = acme
+
+	tests := []struct {
+		name   string
+		issuer string
+		key    crypto.Signer
+		tenant string
+	}{
+		{name: "default tenant", issuer: testIssuer, key: keys.rsa, tenant: DefaultTenant},
+		{name: "other tenant", issuer: acmeIssuer, key: otherKeys.rsa, tenant: "acme"},
+		// Same kid, but only the keys of the named issuer are tried
+		{name: "key of another tenant", issuer: acmeIssuer, key: keys.rsa},
+		{name: "issuer of another tenant", issuer: testIssuer, key: otherKeys.rsa},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"iss": test.issuer, "exp": time.Now().Add(time.Hour).Unix()}
+			signed := signTestToken(t, jwt.SigningMethodRS256, test.key, "rs", claims)
+			valid, token, err := validator.ValidateToken(context.Background(), signed)
+			if test.tenant == "" {
+				var tokenErr *TokenError
+				if !errors.As(err, &tokenErr) || tokenErr.Description != "invalid signature" {
+					t.Errorf("got %v, want an invalid signature", err)
+				}
+				return
+			}
+			if err != nil || !valid {
+				t.Fatalf("rejected: %v", err)
+			}
+			if tenant := validator.Tenant(token); tenant != test.tenant {
+				t.Errorf("tenant %q, want %q", tenant, test.tenant)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+type typingKey struct {
+	room     string
+	username string
+}
+
+type typingState struct {
+	timer         *time.Timer
+	lastForwarded time.Time
+}
+
+type typingWindow struct {
+	start time.Time
+	count int
+}
+
+// TypingTracker keeps the typing indicators alive on the server. An indicator
+// expires after the timeout unless refreshed, repeated starts are only
+// forwarded once per interval and every user gets a budget of typing frames
+// per second across all rooms.
+type TypingTracker struct {
+	mutex     sync.Mutex
+	timeout   time.Duration
+	interval  time.Duration
+	maxPerSec int
+	active    map[typingKey]*typingState
+	windows   map[string]*typingWindow
+	lastSweep time.Time
+	onExpire  func(room, username string)
+}
+
+func NewTypingTracker(timeout, interval time.Duration, maxPerSec int) *TypingTracker {
+	return &TypingTracker{
+		timeout:   timeout,
+		interval:  interval,
+		maxPerSec: maxPerSec,
+		active:    make(map[typingKey]*typingState),
+		windows:   make(map[string]*typingWindow),
+		lastSweep: time.Now(),
+		onExpire:  func(string, string) {},
+	}
+}
+
+func (t *TypingTracker) OnExpire(fn func(room, username string)) {
+	t.onExpire = fn
+}
+
+// allow must be called with the mutex held, user is the UserKey
+func (t *TypingTracker) allow(user string, now time.Time) bool {
+	if now.Sub(t.lastSweep) > time.Minute {
+		for key, window := range t.windows {
+			if now.Sub(window.start) > time.Second {
+				delete(t.windows, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	window, ok := t.windows[user]
+	if !ok || now.Sub(window.start) > time.Second {
+		t.windows[user] = &typingWindow{start: now, count: 1}
+		return true
+	}
+	window.count++
+	return window.count <= t.maxPerSec
+}
+
+// Start reports whether the typing.start should be forwarded to the room
+func (t *TypingTracker) Start(room, tenant, username string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	if !t.allow(UserKey(tenant, username), now) {
+		return false
+	}
+	key := typingKey{room: room, username: username}
+	state, ok := t.active[key]
+	if ok {
+		state.timer.Reset(t.timeout)
+		if now.Sub(state.lastForwarded) < t.interval {
+			return false
+		}
+		state.lastForwarded = now
+		return true
+	}
+	state = &typingState{lastForwarded: now}
+	state.timer = time.AfterFunc(t.timeout, func() {
+		t.expire(key, state)
+	})
+	t.active[key] = state
+	return true
+}
+
+// Stop reports whether the user was typing, and so whether the stop should be forwarded
+func (t *TypingTracker) Stop(room, tenant, username string, throttle bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if throttle && !t.allow(UserKey(tenant, username), time.Now()) {
+		return false
+	}
+	key := typingKey{room: room, username: username}
+	state, ok := t.active[key]
+	if !ok {
+		return false
+	}
+	state.timer.Stop()
+	delete(t.active, key)
+	return true
+}
+
+func (t *TypingTracker) expire(key typingKey, state *typingState) {
+	t.mutex.Lock()
+	// The state may have been stopped and replaced in the meantime
+	if t.active[key] != state {
+		t.mutex.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mutex.Unlock()
+	t.onExpire(key.room, key.username)
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingTracker(t *testing.T) {
+	type step struct {
+		stop   bool
+		room   string
+		tenant string
+		want   bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "repeated start within the interval",
+			steps: []step{{room: "a", want: true}, {room: "a", want: false}},
+		},
+		{
+			name:  "start in another room",
+			steps: []step{{room: "a", want: true}, {room: "b", want: true}},
+		},
+		{
+			name:  "stop after start",
+			steps: []step{{room: "a", want: true}, {stop: true, room: "a", want: true}, {room: "a", want: true}},
+		},
+		{
+			name:  "stop without start",
+			steps: []step{{stop: true, room: "a", want: false}},
+		},
+		{
+			name: "budget per second",
+			steps: []step{
+				{room: "a", want: true},
+				{room: "b", want: true},
+				{room: "c", want: true},
+				{room: "d", want: false},
+				// The same username in another tenant is someone else
+				{room: "d", tenant: "acme", want: true},
+			},
+		},
+		{
+			name:  "stop over the budget",
+			steps: []step{{room: "a", want: true}, {room: "b", want: true}, {room: "c", want: true}, {stop: true, room: "a", want: false}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewTypingTracker(time.Minute, time.Minute, 3)
+			for i, step := range test.steps {
+				tenant := step.tenant
+				if tenant == "" {
+					tenant = DefaultTenant
+				}
+				var forwarded bool
+				if step.stop {
+					forwarded = tracker.Stop(step.room, tenant, "alice", true)
+				} else {
+					forwarded = tracker.Start(step.room, tenant, "alice")
+				}
+				if forwarded != step.want {
+					t.Errorf("step %d %+v forwarded %v", i, step, forwarded)
+				}
+			}
+		})
+	}
+}
+
+func TestTypingTrackerExpires(t *testing.T) {
+	tracker := NewTypingTracker(20*time.Millisecond, time.Minute, 10)
+	expired := make(chan string, 1)
+	tracker.OnExpire(func(room, username string) {
+		expired <- room + "/" + username
+	})
+	if !tracker.Start("a", DefaultTenant, "alice") {
+		t.Fatal("the first start was not forwarded")
+	}
+	select {
+	case got := <-expired:
+		if got != "a/alice" {
+			t.Errorf("expired %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the indicator did not expire")
+	}
+	if tracker.Stop("a", DefaultTenant, "alice", false) {
+		t.Error("an expired indicator was stopped")
+	}
+	if !tracker.Start("a", DefaultTenant, "alice") {
+		t.Error("start after expiring was not forwarded")
+	}
+}
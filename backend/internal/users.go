@@ -17,7 +17,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/disintegration/imaging"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
@@ -29,23 +28,29 @@ type UsersRouter struct {
 	s3Client          *s3.Client
 	PresignClient     *s3.PresignClient
 	cognitoClient     *cognito.Client
-	userPoolId        string
+	directory         *UserDirectory
+	presence          *PresenceTracker
+	rooms             RoomStore
 	AvatarsBucketName string
 }
 
 func NewUsersRouter(conf *Config, logger *zap.Logger,
 	rootRouter *mux.Router,
 	awsCfg *aws.Config,
-	validator *TokenValidator) *UsersRouter {
+	validator *TokenValidator,
+	directory *UserDirectory,
+	presence *PresenceTracker,
+	rooms RoomStore) *UsersRouter {
 	router := rootRouter.PathPrefix("/users").Subrouter()
 	router.Use(validator.ValidatingMiddleware)
 	s3Client := s3.NewFromConfig(*awsCfg)
 	presign := s3.NewPresignClient(s3Client)
-	cognitoClient := cognito.NewFromConfig(*awsCfg)
 	usersRouter := &UsersRouter{logger: logger,
-		userPoolId:        conf.UserPoolId,
 		s3Client:          s3Client,
-		cognitoClient:     cognitoClient,
+		cognitoClient:     directory.client,
+		directory:         directory,
+		presence:          presence,
+		rooms:             rooms,
 		PresignClient:     presign,
 		AvatarsBucketName: conf.AvatarsBucketName,
 		router:            router}
@@ -58,6 +63,7 @@ func (u *UsersRouter) registerRoutes() {
 		Methods("POST").
 		HeadersRegexp("Content-Type", "image/.*")
 	u.router.HandleFunc("/me/avatar", u.GetAvatar).Methods("GET")
+	u.router.HandleFunc("/{username}/presence", u.GetPresence).Methods("GET")
 }
 
 const (
@@ -71,14 +77,7 @@ type AvatarResponse struct {
 }
 
 func (u *UsersRouter) getUserId(r *http.Request) (string, error) {
-	token := GetParsedToken(r)
-	if token == nil {
-		return "", errors.New("unable to fetch token from the request context")
-	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		return claims[CognitoUsernameClaim].(string), nil
-	}
-	return "", errors.New("unable to fetch claims from token")
+	return GetTokenUsername(GetParsedToken(r))
 }
 
 func (u *UsersRouter) GetAvatar(w http.ResponseWriter, r *http.Request) {
@@ -88,16 +87,12 @@ func (u *UsersRouter) GetAvatar(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	user, err := u.cognitoClient.AdminGetUser(r.Context(), &cognito.AdminGetUserInput{
-		UserPoolId: &u.userPoolId,
-		Username:   &userId,
-	})
+	attributes, err := u.directory.GetUserAttributes(r.Context(), GetTenant(r), userId)
 	if err != nil {
 		u.logger.Warn("Failed to get user", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	attributes := ToUserAttributesMap(user.UserAttributes)
 	location, ok := attributes[AvatarLocationAttribute]
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
@@ -135,6 +130,12 @@ func (u *UsersRouter) UploadAvatar(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	userPoolId, err := u.directory.UserPoolId(GetTenant(r))
+	if err != nil {
+		u.logger.Error("unable to find user pool", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	avatarId := uuid.New().String()
 	reader := http.MaxBytesReader(w, r.Body, MaxAvatarSize)
 	defer ignore(reader.Close)
@@ -171,7 +172,7 @@ func (u *UsersRouter) UploadAvatar(w http.ResponseWriter, r *http.Request) {
 	_, err = u.cognitoClient.AdminUpdateUserAttributes(
 		r.Context(),
 		&cognito.AdminUpdateUserAttributesInput{
-			UserPoolId: &u.userPoolId,
+			UserPoolId: &userPoolId,
 			Username:   &userId,
 			UserAttributes: []types.AttributeType{
 				{
@@ -187,3 +188,29 @@ func (u *UsersRouter) UploadAvatar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// GetPresence answers only for users sharing a room with the caller,
+// everyone else is reported as missing
+func (u *UsersRouter) GetPresence(w http.ResponseWriter, r *http.Request) {
+	caller, err := u.getUserId(r)
+	if err != nil {
+		u.logger.Error("unable to fetch user id", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tenant := GetTenant(r)
+	username := mux.Vars(r)["username"]
+	if username != caller {
+		shared, err := SharesRoom(r.Context(), u.rooms, tenant, caller, username)
+		if err != nil {
+			u.logger.Error("failed to list rooms for presence", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !shared {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	WriteJSON(w, u.presence.Get(tenant, username), http.StatusOK)
+}
@@ -1,10 +1,14 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	cognitoTypes "github.com/aws/aws-sdk-go-v2/service/cognitoidentityprovider/types"
+	"github.com/go-playground/validator/v10"
 )
 
 func ignore(f func() error) {
@@ -16,6 +20,56 @@ func WriteString(w http.ResponseWriter, s string, code int) {
 	_, _ = w.Write([]byte(s))
 }
 
+const MaxRequestBodySize = 64 * 1024
+
+var requestValidator = validator.New()
+
+// ReadJSON decodes and validates a request body
+func ReadJSON(w http.ResponseWriter, r *http.Request, value any) error {
+	reader := http.MaxBytesReader(w, r.Body, MaxRequestBodySize)
+	defer ignore(reader.Close)
+	if err := json.NewDecoder(reader).Decode(value); err != nil {
+		return err
+	}
+	return requestValidator.Struct(value)
+}
+
+func WriteJSON(w http.ResponseWriter, value any, code int) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(HeaderContentType, ContentTypeJSON)
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+// WriteJSONFile replaces the file atomically so a crash never leaves it half written
+func WriteJSONFile(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadJSONFile leaves value untouched when the file does not exist
+func ReadJSONFile(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
 func ToUserAttributesMap(attributes []cognitoTypes.AttributeType) map[string]string {
 	result := make(map[string]string)
 	for _, attribute := range attributes {
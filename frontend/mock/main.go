@@ -121,6 +121,24 @@ func (s *MockServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("%s?state=%s", redirect, state), http.StatusFound)
 }
 
+type PresenceResponse struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+func (s *MockServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	response, err := json.Marshal(PresenceResponse{
+		Username: r.PathValue("username"),
+		Status:   "online",
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(response)
+}
+
 type KeyResponse struct {
 	E   string `json:"e"`
 	N   string `json:"n"`
@@ -187,6 +205,7 @@ func (s *MockServer) Serve() {
 	mux.HandleFunc("POST /oauth2/token", s.handleToken)
 	mux.HandleFunc("GET /oauth2/userInfo", s.handleUserInfo)
 	mux.HandleFunc("GET /api/users/me/avatar", http.NotFound)
+	mux.HandleFunc("GET /api/users/{username}/presence", s.handlePresence)
 	mux.HandleFunc("GET /.well-known/jwks.json", s.handleJwks)
 	mux.HandleFunc("GET /.well-known/openid-configuration", s.handleOpenIdConfig)
 	port := getEnv("PORT", "9090")
@@ -1,17 +1,26 @@
 import type { CSSProperties } from "react";
+import type { PresenceStatus } from "../hooks/usePresence.ts";
 
 type AvatarProps = {
   src?: string;
   children?: string;
   size?: number;
   sizeFit?: boolean;
+  status?: PresenceStatus;
   onClick?: () => void;
 };
 
+const statusClasses: Record<PresenceStatus, string> = {
+  online: "bg-green-500",
+  away: "bg-yellow-400",
+  offline: "bg-gray-400",
+};
+
 export const Avatar = ({
   src,
   children,
   onClick,
+  status,
   size = 16,
   sizeFit = false,
 }: AvatarProps) => {
@@ -40,16 +49,34 @@ export const Avatar = ({
     "flex",
     "items-center",
     "justify-center",
+    "size-full",
     "p-0",
     "m-0",
   ];
+  const statusDotClasses = [
+    "absolute",
+    "bottom-0",
+    "right-0",
+    "w-1/4",
+    "h-1/4",
+    "rounded-full",
+    "border-2",
+    "border-(--color-primary-main)",
+  ];
   return (
     <div
       onClick={onClick}
       style={cssProps}
-      className={containerClasses.concat(sizeClasses).join(" ")}
+      className={["relative"].concat(sizeClasses).join(" ")}
     >
-      {src ? avatarImg : avatarFallback}
+      <div className={containerClasses.join(" ")}>
+        {src ? avatarImg : avatarFallback}
+      </div>
+      {status && (
+        <span
+          className={statusDotClasses.concat(statusClasses[status]).join(" ")}
+        />
+      )}
     </div>
   );
 };
@@ -5,6 +5,7 @@ import { useEffect, useState } from "react";
 import { ClickAwayListener } from "./ClickAwayListener";
 import { Menu, MenuItem } from "./Menu";
 import { useAvatar } from "../AvatarProvider.tsx";
+import { type PresenceStatus, usePresence } from "../hooks/usePresence.ts";
 
 const AnonymousMenu = () => {
   const { loginWithRedirect } = useCognito();
@@ -20,8 +21,10 @@ const AuthenticatedMenu = () => {
   const [avatarUrl, setAvatarUrl] = useState<string | undefined>();
   const [userName, setUserName] = useState<string | null>(null);
   const [menuOpen, setMenuOpen] = useState(false);
+  const [status, setStatus] = useState<PresenceStatus | undefined>();
   const { getUserInfo, logout } = useCognito();
   const { getAvatar } = useAvatar();
+  const { getPresence } = usePresence();
 
   useEffect(() => {
     let url: string | null = null;
@@ -34,6 +37,9 @@ const AuthenticatedMenu = () => {
       } else {
         setUserName(info.username ?? info.name ?? "");
       }
+      if (info.username) {
+        setStatus(await getPresence(info.username));
+      }
     };
 
     setupMenu().catch((error) => console.log(error));
@@ -52,6 +58,7 @@ const AuthenticatedMenu = () => {
           sizeFit={true}
           onClick={() => setMenuOpen(true)}
           src={avatarUrl}
+          status={status}
         >
           {userName?.charAt(0).toUpperCase()}
         </Avatar>
@@ -0,0 +1,33 @@
+import { useCognito } from "../CognitoProvider.tsx";
+
+export type PresenceStatus = "online" | "away" | "offline";
+
+type PresenceResponse = {
+  username: string;
+  status: PresenceStatus;
+  last_seen?: string;
+};
+
+export const usePresence = () => {
+  const { getAccessToken } = useCognito();
+
+  const getPresence = async (username: string): Promise<PresenceStatus> => {
+    const token = await getAccessToken();
+    const response = await fetch(
+      `/api/users/${encodeURIComponent(username)}/presence`,
+      {
+        method: "GET",
+        headers: {
+          Authorization: `Bearer ${token}`,
+        },
+      },
+    );
+    if (!response.ok) {
+      return "offline";
+    }
+    const result: PresenceResponse = await response.json();
+    return result.status;
+  };
+
+  return { getPresence };
+};